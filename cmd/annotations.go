@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultAnnotationPrefix is the prefix of annotated tags if unspecified.
+const DefaultAnnotationPrefix = "external-dns/"
+
+// annotations holds the values of the annotated tags of a service, keyed by the annotation key without the prefix.
+// A key has several values when its tag is repeated.
+type annotations map[string][]string
+
+// parseAnnotationPrefix validates the configured prefix of annotated tags. The prefix is separated from the key
+// with a `/`, which is appended if missing, so that `public-dns` matches `public-dns/hostname=...` instead of nothing.
+// A `=` would end up in the key, so such a prefix is rejected.
+func parseAnnotationPrefix(value string) (string, error) {
+	prefix := strings.TrimSpace(value)
+	if prefix == "" {
+		return DefaultAnnotationPrefix, nil
+	}
+	if strings.Contains(prefix, "=") {
+		return "", fmt.Errorf("annotation prefix %q should not contain `=`", value)
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix, nil
+}
+
+// parseAnnotations parses the tags in the form of `<prefix><key>=<value>`, like `external-dns/hostname=redis.test.internal`.
+// This is the only place where tags are parsed, so that the prefix applies to every annotation.
+// Tags without the prefix or a value are ignored.
+func parseAnnotations(prefix string, tags []string) annotations {
+	a := make(annotations)
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, prefix) {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(tag, prefix), "=")
+		if !ok || key == "" {
+			continue
+		}
+		a[key] = append(a[key], value)
+	}
+	return a
+}
+
+// get returns the first value of the annotation.
+func (a annotations) get(key string) (string, bool) {
+	if values := a[key]; len(values) > 0 {
+		return values[0], true
+	}
+	return "", false
+}
+
+// all returns every value of the annotation, in the order of the tags.
+func (a annotations) all(key string) []string {
+	return a[key]
+}
+
+// sameAnnotations checks if two sets of annotations have the same values.
+func sameAnnotations(a1, a2 annotations) bool {
+	if len(a1) != len(a2) {
+		return false
+	}
+	for k, v := range a1 {
+		if !sameStringSlice(v, a2[k]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAnnotations(t *testing.T) {
+	tags := []string{
+		"public-dns/hostname=web.example.com",
+		"public-dns/hostname=www.example.com",
+		"public-dns/ttl=1m",
+		"public-dns/target",             // Without a value.
+		"private-dns/hostname=web.test", // Annotation of another instance.
+		"traefik.enable=true",
+	}
+
+	a := parseAnnotations("public-dns/", tags)
+	assert.Equal(t, annotations{
+		"hostname": {"web.example.com", "www.example.com"},
+		"ttl":      {"1m"},
+	}, a)
+
+	v, ok := a.get(HostnameAnnotationKey)
+	assert.True(t, ok)
+	assert.Equal(t, "web.example.com", v)
+	assert.True(t, hasHostnameAnnotation(a))
+	assert.Equal(t, []string{"web.example.com", "www.example.com"}, getDNSNames(a))
+
+	_, ok = a.get(TargetAnnotationKey)
+	assert.False(t, ok)
+
+	// The default prefix doesn't match any of the tags.
+	assert.False(t, hasHostnameAnnotation(parseAnnotations(DefaultAnnotationPrefix, tags)))
+}
+
+func TestParseAnnotationPrefix(t *testing.T) {
+	for value, want := range map[string]string{
+		"":             DefaultAnnotationPrefix,
+		"public-dns/":  "public-dns/",
+		"public-dns":   "public-dns/",
+		" public-dns ": "public-dns/",
+	} {
+		got, err := parseAnnotationPrefix(value)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got, value)
+	}
+
+	_, err := parseAnnotationPrefix("public-dns/hostname=")
+	assert.Error(t, err)
+}
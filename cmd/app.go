@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"sort"
 	"sync"
+	"text/template"
 	"time"
 
-	"github.com/hashicorp/nomad/api"
 	"golang.org/x/exp/slog"
 )
 
@@ -16,6 +18,28 @@ type Opts struct {
 	owner          string
 	domains        []string
 	dryRun         bool
+	watchEvents    bool
+
+	// maxConcurrentFetches bounds the number of services fetched in parallel from Nomad.
+	maxConcurrentFetches int
+	// healthyOnly publishes only the allocations whose checks are passing, unless overridden by a service.
+	healthyOnly bool
+	// healthyFailOpen keeps all the allocations of a service in the records if none of them are healthy.
+	healthyFailOpen bool
+	// annotationPrefix is the prefix of the annotated tags this instance reacts to.
+	annotationPrefix string
+	// metaAnnotations reads annotations from the meta of services, groups and jobs as well.
+	metaAnnotations bool
+	// filters restricts the services exported from the Nomad cluster.
+	filters sourceFilters
+	// hostnameTemplate derives the hostname of services in templateNamespaces
+	// or with the AutoHostnameAnnotationKey tag, which don't have a hostname annotation.
+	hostnameTemplate   *template.Template
+	templateNamespaces []string
+	// httpAddress is the address of the HTTP server for the metrics and probes. It's disabled if empty.
+	httpAddress string
+	// policy restricts the kind of changes which are made to the DNS records.
+	policy syncPolicy
 }
 
 // App is the global container that holds
@@ -23,30 +47,132 @@ type Opts struct {
 type App struct {
 	sync.RWMutex
 
-	lo          *slog.Logger
-	opts        Opts
-	provider    DNSProvider
-	nomadClient *api.Client
-	services    map[string]ServiceMeta
+	lo        *slog.Logger
+	opts      Opts
+	providers []providerInstance
+	sources   []*nomadSource
+	services  map[string]ServiceMeta
+	// resync is set when `services` may not reflect the records, i.e. when becoming the leader or after a failed sync,
+	// so that every service is compared against the DNS providers at the next sync.
+	resync bool
+	// zones serializes the changes to the records of each zone, as the lock above isn't held while calling the DNS providers.
+	zones zoneLocks
+
+	// guard holds back the deletion of records when pruning. It's only used by one prune at a time.
+	guard deletionGuard
+	// probes tracks the workers and the calls to Nomad and the DNS providers for the health and readiness endpoints.
+	probes probeState
+	// inspect keeps the results of the last sync and prune for the inspection API.
+	inspect inspectState
+	// dryRunChanges keeps the changes planned in dry run mode, so that each of them is counted once.
+	dryRunChanges plannedChanges
+	// leaderLock is the lock for leader election. The workers always run if it's nil.
+	leaderLock leaderLock
+}
+
+// zoneLocks holds a lock for every zone, so that the records of a zone are fetched, planned and changed by one
+// sync or prune at a time. Otherwise a prune could delete the records of a service which is synced concurrently.
+type zoneLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// lock locks the given zones and returns a function to unlock them.
+// The zones are locked in order, so that callers locking several of them don't deadlock.
+func (z *zoneLocks) lock(zones []string) func() {
+	names := make([]string, 0, len(zones))
+	for _, zone := range zones {
+		if zone = EnsureFQDN(zone); !Contains(names, zone) {
+			names = append(names, zone)
+		}
+	}
+	sort.Strings(names)
+
+	locks := make([]*sync.Mutex, 0, len(names))
+	z.mu.Lock()
+	if z.locks == nil {
+		z.locks = make(map[string]*sync.Mutex)
+	}
+	for _, name := range names {
+		if z.locks[name] == nil {
+			z.locks[name] = &sync.Mutex{}
+		}
+		locks = append(locks, z.locks[name])
+	}
+	z.mu.Unlock()
+
+	for _, l := range locks {
+		l.Lock()
+	}
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+	}
+}
+
+// syncedServices returns a copy of the services whose records are synced, so that they can be compared against
+// the records without holding the lock.
+func (app *App) syncedServices() map[string]ServiceMeta {
+	app.RLock()
+	defer app.RUnlock()
+
+	services := make(map[string]ServiceMeta, len(app.services))
+	for key, s := range app.services {
+		services[key] = s
+	}
+	return services
 }
 
 // Start initialises background workers and waits for them to exit on cancellation.
+// With leader election, the workers only run while this instance holds the leader lock.
 func (app *App) Start(ctx context.Context) {
 	var wg sync.WaitGroup
 
-	app.runWorker(ctx, &wg, app.opts.updateInterval, app.UpdateServices, "updater")
-	app.runWorker(ctx, &wg, app.opts.pruneInterval, app.PruneRecords, "pruner")
+	if app.opts.httpAddress != "" {
+		app.runHTTPServer(ctx, &wg)
+	}
+
+	if app.leaderLock != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			app.campaign(ctx, app.leaderLock, app.runWorkers)
+		}()
+	} else {
+		app.runWorkers(ctx, &wg)
+	}
 
 	// Wait for all routines to finish.
 	wg.Wait()
 }
 
+// runWorkers starts the workers which sync the records, and returns right away.
+func (app *App) runWorkers(ctx context.Context, wg *sync.WaitGroup) {
+	app.Lock()
+	app.resync = true
+	app.Unlock()
+
+	// The updater runs a full resync of all services at every interval. When watching events,
+	// individual services are additionally reconciled as soon as they change in Nomad.
+	app.runWorker(ctx, wg, app.opts.updateInterval, app.UpdateServices, "updater")
+	if app.opts.watchEvents {
+		for _, src := range app.sources {
+			app.runEventWatcher(ctx, wg, src)
+		}
+	}
+	app.runWorker(ctx, wg, app.opts.pruneInterval, app.PruneRecords, "pruner")
+}
+
 // runWorker is a helper function to encapsulate the goroutine spawning and error handling logic.
 func (app *App) runWorker(ctx context.Context, wg *sync.WaitGroup, interval time.Duration, workerFunc func(context.Context), workerName string) {
 	wg.Add(1)
 
+	app.probes.workerStarted(workerName, interval, time.Now())
+
 	go func() {
 		defer wg.Done()
+		defer app.probes.workerStopped(workerName)
 
 		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
@@ -55,6 +181,7 @@ func (app *App) runWorker(ctx context.Context, wg *sync.WaitGroup, interval time
 			select {
 			case <-ticker.C:
 				workerFunc(ctx)
+				app.probes.workerRan(workerName, time.Now())
 			case <-ctx.Done():
 				app.lo.Warn("Context cancellation received, terminating worker", "worker", workerName)
 				return
@@ -63,32 +190,71 @@ func (app *App) runWorker(ctx context.Context, wg *sync.WaitGroup, interval time
 	}()
 }
 
+// providerForZone returns the provider which owns the given zone.
+func (app *App) providerForZone(zone string) (providerInstance, error) {
+	for _, p := range app.providers {
+		for _, d := range p.domains {
+			if EnsureFQDN(d) == EnsureFQDN(zone) {
+				return p, nil
+			}
+		}
+	}
+	return providerInstance{}, fmt.Errorf("no provider configured for zone %s", zone)
+}
+
+// sourceByName returns the Nomad source with the given name, or nil if there's none.
+func (app *App) sourceByName(name string) *nomadSource {
+	for _, src := range app.sources {
+		if src.name == name {
+			return src
+		}
+	}
+	return nil
+}
+
 // UpdateServices fetches Nomad services from all the namespaces
 // and updates the records in upstream DNS providers.
 func (app *App) UpdateServices(ctx context.Context) {
+	if err := app.syncServices(ctx); err != nil {
+		app.lo.Error("Failed to sync services", "error", err)
+		return
+	}
+
+	setLastSuccess("sync", time.Now())
+}
+
+// syncServices fetches the services from Nomad and updates their records,
+// and returns an error if the services couldn't be fetched or the records of any of them couldn't be updated.
+func (app *App) syncServices(ctx context.Context) error {
 	// Fetch the list of services from the cluster.
-	services, err := app.fetchNomadServices()
+	services, err := app.fetchNomadServices(ctx)
 	if err != nil {
-		app.lo.Error("Failed to fetch services", "error", err)
-		return
+		return fmt.Errorf("error fetching services: %w", err)
 	}
+	services = app.filterHealthyServices(ctx, services)
 
 	// Update DNS records for the services fetched.
-	// This function holds a read lock to determine whether to update records or not.
-	app.updateRecords(services, app.opts.domains)
+	// This function locks the zones of the changed services while it updates their records.
+	err = app.updateRecords(ctx, services, app.opts.domains)
 
 	// Add the updated services map to the app once the records are synced.
 	app.Lock()
 	app.services = services
+	app.resync = err != nil
 	app.Unlock()
+	app.inspect.retainErrors(services)
+
+	return err
 }
 
 // PruneRecords fetches the records for all zones from the DNS provider and checks
 // whether the service exists in Nomad cluster. If it doesn't exist then it prunes the record in Provider.
 func (app *App) PruneRecords(ctx context.Context) {
 	// cleanupRecords handles DNS deletions for unused records.
-	if err := app.cleanupRecords(); err != nil {
+	if err := app.cleanupRecords(ctx); err != nil {
 		app.lo.Error("Failed to fetch records", "error", err)
 		return
 	}
+
+	setLastSuccess("prune", time.Now())
 }
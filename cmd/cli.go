@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	flag "github.com/spf13/pflag"
+)
+
+// commandUsage describes the commands of the CLI.
+const commandUsage = `
+Commands:
+  run            Run the daemon which keeps syncing the records. This is the default.
+  plan           Print the changes to the records between the services in Nomad and the DNS providers.
+  sync --once    Sync and prune the records once and exit. Without --once, the daemon is run.
+                 Records are only deleted with --force.
+  records        List the records owned by nomad-external-dns in every zone.
+  prune          Prune the records, after confirming the changes. With --yes, records are only deleted with --force.
+`
+
+// Exit codes of the commands.
+const (
+	exitOK      = 0
+	exitError   = 1
+	exitChanges = 2 // Returned by `plan --exit-code` if there are changes.
+)
+
+// runCommand runs the command with its arguments, and returns the exit code.
+// The daemon is run if no command is given.
+func (app *App) runCommand(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) int {
+	cmd := "run"
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+
+	// Each command only accepts its own flags, so that e.g. `run --once` fails instead of running the daemon.
+	var (
+		f                          = flag.NewFlagSet(cmd, flag.ContinueOnError)
+		once, exitCode, yes, force = new(bool), new(bool), new(bool), new(bool)
+	)
+	switch cmd {
+	case "run", "records":
+	case "sync":
+		once = f.Bool("once", false, "Sync and prune the records once and exit.")
+		force = f.Bool("force", false, "Delete records without confirmation.")
+	case "plan":
+		exitCode = f.Bool("exit-code", false, "Exit with status 2 if there are changes.")
+	case "prune":
+		yes = f.BoolP("yes", "y", false, "Apply the changes without confirmation.")
+		force = f.Bool("force", false, "Delete records without confirmation.")
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n%s", cmd, commandUsage)
+		return exitError
+	}
+	if err := f.Parse(args); err != nil {
+		fmt.Fprintf(os.Stderr, "error parsing flags: %v\n", err)
+		return exitError
+	}
+	if f.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected arguments for %s: %s\n", cmd, strings.Join(f.Args(), " "))
+		return exitError
+	}
+
+	var err error
+	switch cmd {
+	case "run":
+		app.Start(ctx)
+		return exitOK
+	case "sync":
+		if !*once {
+			app.Start(ctx)
+			return exitOK
+		}
+		app.guard.oneShot, app.guard.confirmed = true, *force
+		err = app.runLocked(ctx, app.syncOnce)
+	case "plan":
+		// The deletes are shown as they'd be confirmed by `prune`.
+		app.guard.oneShot, app.guard.confirmed = true, true
+		var changes bool
+		changes, err = app.printPlans(ctx, stdout)
+		if err == nil && changes && *exitCode {
+			return exitChanges
+		}
+	case "records":
+		err = app.printRecords(ctx, stdout)
+	case "prune":
+		app.guard.oneShot, app.guard.confirmed = true, !*yes || *force
+		err = app.runLocked(ctx, func(ctx context.Context) error {
+			return app.pruneOnce(ctx, stdin, stdout, *yes)
+		})
+	}
+
+	if err != nil {
+		app.lo.Error("Command failed", "command", cmd, "error", err)
+		return exitError
+	}
+	return exitOK
+}
+
+// runLocked runs a one-shot command which changes the records while holding the leader lock, if leader election
+// is enabled. Nothing is changed in dry run mode, so the lock isn't needed.
+func (app *App) runLocked(ctx context.Context, run func(ctx context.Context) error) error {
+	if app.leaderLock == nil || app.opts.dryRun {
+		return run(ctx)
+	}
+	return app.runLockedWith(ctx, app.leaderLock, run)
+}
+
+// syncOnce syncs the services and prunes the records once. In one-shot commands, records can't be observed to be
+// absent over several prunes, so records are only deleted if confirmed with `--force`. The thresholds still apply.
+func (app *App) syncOnce(ctx context.Context) error {
+	if err := app.syncServices(ctx); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return app.cleanupRecords(ctx)
+}
+
+// fetchServices fetches the services from Nomad to compare the records against, without updating any records.
+func (app *App) fetchServices(ctx context.Context) error {
+	services, err := app.fetchNomadServices(ctx)
+	if err != nil {
+		return fmt.Errorf("error fetching services: %w", err)
+	}
+
+	app.Lock()
+	app.services = app.filterHealthyServices(ctx, services)
+	app.Unlock()
+	return nil
+}
+
+// planProviders plans the changes for every provider, by the name of the provider.
+func (app *App) planProviders(ctx context.Context) (map[string]Plan, error) {
+	if err := app.fetchServices(ctx); err != nil {
+		return nil, err
+	}
+
+	plans := make(map[string]Plan, len(app.providers))
+	for _, p := range app.providers {
+		plan, err := app.planProvider(ctx, p)
+		if err != nil {
+			return nil, fmt.Errorf("error planning records for provider %s: %w", p.name, err)
+		}
+		plans[p.name] = plan
+	}
+	return plans, nil
+}
+
+// printPlans prints the changes for every provider and returns true if there are any.
+func (app *App) printPlans(ctx context.Context, w io.Writer) (bool, error) {
+	plans, err := app.planProviders(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	changes := false
+	for _, p := range app.providers {
+		printPlan(w, p.name, plans[p.name])
+		changes = changes || !plans[p.name].isEmpty()
+	}
+	return changes, nil
+}
+
+// pruneOnce prints the changes for every provider and applies them once confirmed, or right away with `yes`.
+// Nothing is applied in dry run mode.
+func (app *App) pruneOnce(ctx context.Context, stdin io.Reader, w io.Writer, yes bool) error {
+	plans, err := app.planProviders(ctx)
+	if err != nil {
+		return err
+	}
+	return app.confirmPlans(ctx, plans, stdin, w, yes)
+}
+
+// confirmPlans prints the plans of the providers and applies them once confirmed, or right away with `yes`.
+// Nothing is applied if the context is cancelled in the meantime, e.g. when the leader lock is lost.
+func (app *App) confirmPlans(ctx context.Context, plans map[string]Plan, stdin io.Reader, w io.Writer, yes bool) error {
+	changes := false
+	for _, p := range app.providers {
+		printPlan(w, p.name, plans[p.name])
+		changes = changes || !plans[p.name].isEmpty()
+	}
+	if !changes || app.opts.dryRun {
+		return nil
+	}
+
+	if !yes {
+		fmt.Fprint(w, "Apply these changes? Only 'yes' will be accepted: ")
+		answer, _ := bufio.NewReader(stdin).ReadString('\n')
+		if strings.TrimSpace(answer) != "yes" {
+			fmt.Fprintln(w, "Aborted, no changes were applied.")
+			return nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	failed := make([]string, 0)
+	for _, p := range app.providers {
+		if err := app.applyProviderPlan(ctx, plans[p.name]); err != nil {
+			app.lo.Error("Failed to apply changes", "provider", p.name, "error", err)
+			failed = append(failed, p.name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("error applying changes for providers: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// printPlan prints the changes of a plan, with `+` for creates, `~` for updates and `-` for deletes.
+func printPlan(w io.Writer, provider string, plan Plan) {
+	fmt.Fprintf(w, "Provider %s: %d to create, %d to update, %d to delete.\n",
+		provider, len(plan.Creates), len(plan.Updates), len(plan.Deletes))
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, c := range plan.Creates {
+		fmt.Fprintf(tw, "  +\t%s\t%s\t%s\t%s\n", keyOf(c.Record, c.Zone).name, c.Record.Type, c.Record.TTL, c.Record.Value)
+	}
+	for _, c := range plan.Updates {
+		fmt.Fprintf(tw, "  ~\t%s\t%s\t%s\t%s -> %s\n", keyOf(c.Record, c.Zone).name, c.Record.Type, c.Record.TTL, c.Previous.Value, c.Record.Value)
+	}
+	for _, c := range plan.Deletes {
+		fmt.Fprintf(tw, "  -\t%s\t%s\t%s\t%s\n", keyOf(c.Record, c.Zone).name, c.Record.Type, c.Record.TTL, c.Record.Value)
+	}
+	tw.Flush()
+}
+
+// printRecords lists the records owned by this program in every zone, for all the Nomad sources.
+func (app *App) printRecords(ctx context.Context, w io.Writer) error {
+	clusters := app.clusters()
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROVIDER\tZONE\tNAME\tTYPE\tTTL\tVALUE")
+	for _, p := range app.providers {
+		recordsMap, _, err := app.fetchRecords(ctx, p, clusters)
+		if err != nil {
+			return fmt.Errorf("error fetching records for provider %s: %w", p.name, err)
+		}
+
+		records := make([]recordView, 0, len(recordsMap))
+		for _, metas := range recordsMap {
+			for _, m := range metas {
+				for _, r := range m.Records {
+					records = append(records, recordView{Zone: m.Zone, Name: keyOf(r, m.Zone).name, Type: r.Type, Value: r.Value, TTL: r.TTL.String()})
+				}
+			}
+		}
+		sortRecordViews(records)
+
+		for _, r := range records {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", p.name, r.Zone, r.Name, r.Type, r.TTL, r.Value)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slog"
+)
+
+// memProvider is an in-memory DNSProvider which stores every value of a record set as a separate record
+// at its fully qualified name, and counts the calls which change records.
+type memProvider struct {
+	mu      sync.Mutex
+	records map[string][]libdns.Record
+	changes int
+}
+
+func (m *memProvider) GetRecords(_ context.Context, zone string) ([]libdns.Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]libdns.Record{}, m.records[zone]...), nil
+}
+
+func (m *memProvider) AppendRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	return m.SetRecords(ctx, zone, recs)
+}
+
+func (m *memProvider) SetRecords(_ context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.changes++
+	m.remove(zone, recs)
+	for _, r := range recs {
+		for _, v := range splitValues(r.Value) {
+			m.records[zone] = append(m.records[zone], libdns.Record{Type: r.Type, Name: keyOf(r, zone).name, Value: v, TTL: r.TTL})
+		}
+	}
+	return recs, nil
+}
+
+func (m *memProvider) DeleteRecords(_ context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.changes++
+	m.remove(zone, recs)
+	return recs, nil
+}
+
+// remove removes every value of the record sets with the names and types of the given records.
+func (m *memProvider) remove(zone string, recs []libdns.Record) {
+	kept := make([]libdns.Record, 0)
+	for _, existing := range m.records[zone] {
+		deleted := false
+		for _, r := range recs {
+			if keyOf(existing, zone) == keyOf(r, zone) {
+				deleted = true
+			}
+		}
+		if !deleted {
+			kept = append(kept, existing)
+		}
+	}
+	m.records[zone] = kept
+}
+
+// values returns the sorted values of the record set with the given fully qualified name and type.
+func (m *memProvider) values(zone, name, typ string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	values := make([]string, 0)
+	for _, r := range m.records[zone] {
+		if r.Name == name && r.Type == typ {
+			values = append(values, r.Value)
+		}
+	}
+	sort.Strings(values)
+	return values
+}
+
+func newCLITestApp(provider *memProvider) *App {
+	return &App{
+		lo:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		opts:      Opts{owner: "test-owner", domains: []string{"test.internal"}},
+		providers: []providerInstance{{name: "mem", provider: provider, domains: []string{"test.internal"}}},
+		sources:   []*nomadSource{newNomadSource("default", "global", nil)},
+		services:  make(map[string]ServiceMeta),
+	}
+}
+
+func TestPrintRecords(t *testing.T) {
+	provider := &memProvider{records: map[string][]libdns.Record{
+		"test.internal.": {
+			{Type: "TXT", Name: "redis.test.internal.", Value: `"service=redis namespace=default cluster=default owner=test-owner created-by=nomad-external-dns"`, TTL: 30 * time.Second},
+			{Type: "A", Name: "redis.test.internal.", Value: "10.0.0.1", TTL: 30 * time.Second},
+			{Type: "A", Name: "redis.test.internal.", Value: "10.0.0.2", TTL: 30 * time.Second},
+			{Type: "A", Name: "unowned.test.internal.", Value: "10.0.0.9", TTL: 30 * time.Second},
+		},
+	}}
+	app := newCLITestApp(provider)
+
+	var out bytes.Buffer
+	assert.NoError(t, app.printRecords(context.Background(), &out))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 3)
+	assert.Equal(t, []string{"PROVIDER", "ZONE", "NAME", "TYPE", "TTL", "VALUE"}, strings.Fields(lines[0]))
+	assert.Equal(t, []string{"mem", "test.internal.", "redis.test.internal.", "A", "30s", "10.0.0.1,10.0.0.2"}, strings.Fields(lines[1]))
+	assert.Contains(t, lines[2], "TXT")
+	assert.NotContains(t, out.String(), "unowned")
+}
+
+func TestPrintPlan(t *testing.T) {
+	var out bytes.Buffer
+	printPlan(&out, "mem", Plan{
+		Creates: []Change{{Zone: "test.internal.", Record: libdns.Record{Type: "A", Name: "web", Value: "10.0.0.1", TTL: 30 * time.Second}}},
+		Updates: []Change{{
+			Zone:     "test.internal.",
+			Record:   libdns.Record{Type: "A", Name: "redis", Value: "10.0.0.2", TTL: 30 * time.Second},
+			Previous: libdns.Record{Type: "A", Name: "redis.", Value: "10.0.0.1", TTL: 30 * time.Second},
+		}},
+		Deletes: []Change{{Zone: "test.internal.", Record: libdns.Record{Type: "A", Name: "gone.", Value: "10.0.0.3", TTL: 30 * time.Second}}},
+	})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, []string{
+		"Provider mem: 1 to create, 1 to update, 1 to delete.",
+		"+  web.test.internal.    A  30s  10.0.0.1",
+		"~  redis.test.internal.  A  30s  10.0.0.1 -> 10.0.0.2",
+		"-  gone.test.internal.   A  30s  10.0.0.3",
+	}, []string{lines[0], strings.TrimSpace(lines[1]), strings.TrimSpace(lines[2]), strings.TrimSpace(lines[3])})
+}
+
+func TestConfirmPlans(t *testing.T) {
+	plan := Plan{Deletes: []Change{{Zone: "test.internal.", Record: libdns.Record{Type: "A", Name: "gone.", Value: "10.0.0.3"}}}}
+	newProvider := func() *memProvider {
+		return &memProvider{records: map[string][]libdns.Record{
+			"test.internal.": {{Type: "A", Name: "gone.test.internal.", Value: "10.0.0.3"}},
+		}}
+	}
+
+	tests := []struct {
+		name    string
+		stdin   string
+		yes     bool
+		dryRun  bool
+		deleted bool
+	}{
+		{name: "confirmed", stdin: "yes\n", deleted: true},
+		{name: "declined", stdin: "no\n"},
+		{name: "no input", stdin: ""},
+		{name: "without confirmation", yes: true, deleted: true},
+		{name: "dry run", yes: true, dryRun: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := newProvider()
+			app := newCLITestApp(provider)
+			app.opts.dryRun = tt.dryRun
+
+			var out bytes.Buffer
+			assert.NoError(t, app.confirmPlans(context.Background(), map[string]Plan{"mem": plan}, strings.NewReader(tt.stdin), &out, tt.yes))
+			if tt.deleted {
+				assert.Empty(t, provider.records["test.internal."])
+			} else {
+				assert.Len(t, provider.records["test.internal."], 1)
+			}
+		})
+	}
+}
+
+func TestRunCommandUnknown(t *testing.T) {
+	app := newCLITestApp(&memProvider{})
+	assert.Equal(t, exitError, app.runCommand(context.Background(), []string{"apply"}, strings.NewReader(""), io.Discard))
+	assert.Equal(t, exitError, app.runCommand(context.Background(), []string{"plan", "--unknown"}, strings.NewReader(""), io.Discard))
+
+	// The flags of other commands are rejected, instead of being ignored.
+	for _, args := range [][]string{{"run", "--once"}, {"records", "--force"}, {"plan", "--yes"}, {"plan", "extra"}, {"sync", "--exit-code"}} {
+		assert.Equal(t, exitError, app.runCommand(context.Background(), args, strings.NewReader(""), io.Discard), args)
+	}
+}
+
+func TestRunCommandLeaderLock(t *testing.T) {
+	provider := &memProvider{records: map[string][]libdns.Record{
+		"test.internal.": {{Type: "A", Name: "gone.test.internal.", Value: "10.0.0.3"}},
+	}}
+	app := newCLITestApp(provider)
+	app.leaderLock = &fakeLock{acquired: true}
+
+	// The commands which change the records refuse to run while the leader holds the lock.
+	for _, args := range [][]string{{"sync", "--once", "--force"}, {"prune", "--yes", "--force"}} {
+		assert.Equal(t, exitError, app.runCommand(context.Background(), args, strings.NewReader(""), io.Discard))
+	}
+	assert.Equal(t, 0, provider.changes)
+}
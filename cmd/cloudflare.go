@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+const (
+	// defaultCloudflareURL is the base URL of the Cloudflare v4 API.
+	defaultCloudflareURL = "https://api.cloudflare.com/client/v4"
+	// cloudflareAutoTTL is the TTL value which Cloudflare treats as "automatic". Proxied records must use it.
+	cloudflareAutoTTL = 1
+	// cloudflareMinTTL is the lowest TTL in seconds which Cloudflare accepts, other than cloudflareAutoTTL.
+	cloudflareMinTTL = 60
+	// cloudflarePageSize is the number of DNS records fetched per page.
+	cloudflarePageSize = 100
+)
+
+// cloudflareOpts represents the configuration for the Cloudflare provider.
+type cloudflareOpts struct {
+	APIToken string
+	BaseURL  string
+	Proxied  bool // Default proxy setting for records which don't specify it.
+	Timeout  time.Duration
+}
+
+// CloudflareProvider implements the DNSProvider interface for Cloudflare.
+// Multiple values of a record are passed as a comma separated `Value` and
+// are stored as individual records in Cloudflare.
+type CloudflareProvider struct {
+	opts   cloudflareOpts
+	client *http.Client
+
+	mu      sync.Mutex
+	zoneIDs map[string]string // Cache of zone name to zone ID.
+}
+
+// cfResponse is the envelope of every Cloudflare API response.
+type cfResponse struct {
+	Success    bool            `json:"success"`
+	Errors     []cfError       `json:"errors"`
+	Result     json.RawMessage `json:"result"`
+	ResultInfo struct {
+		Page       int `json:"page"`
+		TotalPages int `json:"total_pages"`
+	} `json:"result_info"`
+}
+
+type cfError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type cfZone struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type cfRecord struct {
+	ID      string     `json:"id,omitempty"`
+	Type    string     `json:"type"`
+	Name    string     `json:"name"`
+	Content string     `json:"content,omitempty"`
+	TTL     int        `json:"ttl"`
+	Proxied *bool      `json:"proxied,omitempty"`
+	Data    *cfSRVData `json:"data,omitempty"`
+}
+
+// cfSRVData holds the fields of an SRV record, which Cloudflare expects separately instead of as the content.
+type cfSRVData struct {
+	Priority int    `json:"priority"`
+	Weight   int    `json:"weight"`
+	Port     int    `json:"port"`
+	Target   string `json:"target"`
+}
+
+type proxiedCtxKey struct{}
+
+// withProxied returns a context carrying the Cloudflare proxy setting for the records being set.
+// libdns records have no field for provider specific settings, so it's passed along with the request.
+func withProxied(ctx context.Context, proxied bool) context.Context {
+	return context.WithValue(ctx, proxiedCtxKey{}, proxied)
+}
+
+// NewCloudflareProvider initialises a Cloudflare provider.
+func NewCloudflareProvider(opts cloudflareOpts) (*CloudflareProvider, error) {
+	if opts.APIToken == "" {
+		return nil, fmt.Errorf("cloudflare api_token is required")
+	}
+	if opts.BaseURL == "" {
+		opts.BaseURL = defaultCloudflareURL
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Second * 30
+	}
+
+	return &CloudflareProvider{
+		opts:    opts,
+		client:  &http.Client{Timeout: opts.Timeout},
+		zoneIDs: make(map[string]string),
+	}, nil
+}
+
+// GetRecords lists all the records in the zone. Record names are returned as FQDNs.
+func (p *CloudflareProvider) GetRecords(ctx context.Context, zone string) ([]libdns.Record, error) {
+	zoneID, err := p.getZoneID(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	cfRecords, err := p.listRecords(ctx, zoneID, url.Values{})
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]libdns.Record, 0, len(cfRecords))
+	for _, r := range cfRecords {
+		records = append(records, r.toLibdns())
+	}
+	return records, nil
+}
+
+// AppendRecords adds records to the zone. It returns the records that were added.
+func (p *CloudflareProvider) AppendRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
+	zoneID, err := p.getZoneID(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	var created []libdns.Record
+	for _, record := range records {
+		for _, value := range splitValues(record.Value) {
+			r, err := p.createRecord(ctx, zoneID, p.newRecord(ctx, record, value, zone))
+			if err != nil {
+				return created, err
+			}
+			created = append(created, r.toLibdns())
+		}
+	}
+	return created, nil
+}
+
+// SetRecords sets the records in the zone, replacing all existing values of each record's name and type.
+// It returns the updated records.
+func (p *CloudflareProvider) SetRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
+	zoneID, err := p.getZoneID(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	var updated []libdns.Record
+	for _, record := range records {
+		existing, err := p.listRecords(ctx, zoneID, url.Values{
+			"name": {strings.TrimSuffix(libdns.AbsoluteName(record.Name, zone), ".")},
+			"type": {record.Type},
+		})
+		if err != nil {
+			return updated, err
+		}
+
+		// Reuse existing records as much as possible and remove the ones which are left over.
+		values := splitValues(record.Value)
+		for i, value := range values {
+			r := p.newRecord(ctx, record, value, zone)
+			if i < len(existing) {
+				r, err = p.updateRecord(ctx, zoneID, existing[i].ID, r)
+			} else {
+				r, err = p.createRecord(ctx, zoneID, r)
+			}
+			if err != nil {
+				return updated, err
+			}
+			updated = append(updated, r.toLibdns())
+		}
+		for i := len(values); i < len(existing); i++ {
+			if err := p.deleteRecord(ctx, zoneID, existing[i].ID); err != nil {
+				return updated, err
+			}
+		}
+	}
+	return updated, nil
+}
+
+// DeleteRecords deletes the records from the zone. If a record does not have an ID,
+// it will be looked up by its name, type and value. It returns the records that were deleted.
+func (p *CloudflareProvider) DeleteRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
+	zoneID, err := p.getZoneID(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []libdns.Record
+	for _, record := range records {
+		if record.ID != "" {
+			if err := p.deleteRecord(ctx, zoneID, record.ID); err != nil {
+				return deleted, err
+			}
+			deleted = append(deleted, record)
+			continue
+		}
+
+		existing, err := p.listRecords(ctx, zoneID, url.Values{
+			"name": {strings.TrimSuffix(libdns.AbsoluteName(record.Name, zone), ".")},
+			"type": {record.Type},
+		})
+		if err != nil {
+			return deleted, err
+		}
+
+		values := splitValues(record.Value)
+		for _, r := range existing {
+			if !Contains(values, r.toLibdns().Value) {
+				continue
+			}
+			if err := p.deleteRecord(ctx, zoneID, r.ID); err != nil {
+				return deleted, err
+			}
+			deleted = append(deleted, r.toLibdns())
+		}
+	}
+	return deleted, nil
+}
+
+// getZoneID looks up the ID of a zone by its name and caches it.
+func (p *CloudflareProvider) getZoneID(ctx context.Context, zone string) (string, error) {
+	name := strings.TrimSuffix(zone, ".")
+
+	p.mu.Lock()
+	id, ok := p.zoneIDs[name]
+	p.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	var zones []cfZone
+	if _, err := p.do(ctx, http.MethodGet, "/zones?"+url.Values{"name": {name}}.Encode(), nil, &zones); err != nil {
+		return "", fmt.Errorf("error looking up zone %s: %w", name, err)
+	}
+	if len(zones) == 0 {
+		return "", fmt.Errorf("zone %s not found", name)
+	}
+
+	p.mu.Lock()
+	p.zoneIDs[name] = zones[0].ID
+	p.mu.Unlock()
+
+	return zones[0].ID, nil
+}
+
+// listRecords fetches all pages of DNS records in a zone matching the given filters.
+func (p *CloudflareProvider) listRecords(ctx context.Context, zoneID string, filters url.Values) ([]cfRecord, error) {
+	var records []cfRecord
+	filters.Set("per_page", fmt.Sprint(cloudflarePageSize))
+
+	for page := 1; ; page++ {
+		filters.Set("page", fmt.Sprint(page))
+
+		var result []cfRecord
+		resp, err := p.do(ctx, http.MethodGet, fmt.Sprintf("/zones/%s/dns_records?%s", zoneID, filters.Encode()), nil, &result)
+		if err != nil {
+			return nil, fmt.Errorf("error listing records: %w", err)
+		}
+		records = append(records, result...)
+
+		if page >= resp.ResultInfo.TotalPages {
+			break
+		}
+	}
+	return records, nil
+}
+
+func (p *CloudflareProvider) createRecord(ctx context.Context, zoneID string, r cfRecord) (cfRecord, error) {
+	var out cfRecord
+	if _, err := p.do(ctx, http.MethodPost, fmt.Sprintf("/zones/%s/dns_records", zoneID), r, &out); err != nil {
+		return out, fmt.Errorf("error creating record %s: %w", r.Name, err)
+	}
+	return out, nil
+}
+
+func (p *CloudflareProvider) updateRecord(ctx context.Context, zoneID, id string, r cfRecord) (cfRecord, error) {
+	var out cfRecord
+	if _, err := p.do(ctx, http.MethodPut, fmt.Sprintf("/zones/%s/dns_records/%s", zoneID, id), r, &out); err != nil {
+		return out, fmt.Errorf("error updating record %s: %w", r.Name, err)
+	}
+	return out, nil
+}
+
+func (p *CloudflareProvider) deleteRecord(ctx context.Context, zoneID, id string) error {
+	if _, err := p.do(ctx, http.MethodDelete, fmt.Sprintf("/zones/%s/dns_records/%s", zoneID, id), nil, nil); err != nil {
+		return fmt.Errorf("error deleting record %s: %w", id, err)
+	}
+	return nil
+}
+
+// cloudflareTTL converts a TTL into the seconds accepted by Cloudflare. TTLs below cloudflareMinTTL, like the
+// default TTL, are raised to it, while TTLs up to a second are sent as cloudflareAutoTTL.
+func cloudflareTTL(ttl time.Duration) int {
+	seconds := int(ttl.Seconds())
+	switch {
+	case seconds <= cloudflareAutoTTL:
+		return cloudflareAutoTTL
+	case seconds < cloudflareMinTTL:
+		return cloudflareMinTTL
+	}
+	return seconds
+}
+
+// minTTL returns the lowest TTL of the records which aren't proxied, so that the records are planned with the TTL
+// they're stored with, instead of being updated at every prune.
+func (p *CloudflareProvider) minTTL() time.Duration {
+	return cloudflareMinTTL * time.Second
+}
+
+// newRecord converts a single value of a libdns record into a Cloudflare record.
+func (p *CloudflareProvider) newRecord(ctx context.Context, record libdns.Record, value, zone string) cfRecord {
+	r := cfRecord{
+		Type:    record.Type,
+		Name:    strings.TrimSuffix(libdns.AbsoluteName(record.Name, zone), "."),
+		Content: value,
+		TTL:     cloudflareTTL(record.TTL),
+	}
+
+	// SRV records are described by their fields rather than the content.
+	if record.Type == "SRV" {
+		var data cfSRVData
+		if _, err := fmt.Sscanf(value, "%d %d %d %s", &data.Priority, &data.Weight, &data.Port, &data.Target); err == nil {
+			data.Target = strings.TrimSuffix(data.Target, ".")
+			r.Content, r.Data = "", &data
+		}
+	}
+
+	// Only address and CNAME records can be proxied by Cloudflare.
+	if record.Type == "A" || record.Type == "AAAA" || record.Type == "CNAME" {
+		proxied := p.opts.Proxied
+		if v, ok := ctx.Value(proxiedCtxKey{}).(bool); ok {
+			proxied = v
+		}
+		r.Proxied = &proxied
+		if proxied {
+			r.TTL = cloudflareAutoTTL
+		}
+	}
+
+	return r
+}
+
+// toLibdns converts a Cloudflare record to a libdns record with a fully qualified name.
+// The value of SRV records is in the `priority weight port target` format.
+func (r cfRecord) toLibdns() libdns.Record {
+	value := r.Content
+	if r.Type == "SRV" && r.Data != nil {
+		value = fmt.Sprintf("%d %d %d %s", r.Data.Priority, r.Data.Weight, r.Data.Port, EnsureFQDN(r.Data.Target))
+	}
+
+	return libdns.Record{
+		ID:    r.ID,
+		Type:  r.Type,
+		Name:  EnsureFQDN(r.Name),
+		Value: value,
+		TTL:   time.Duration(r.TTL) * time.Second,
+	}
+}
+
+// do sends a request to the Cloudflare API and decodes the result into `out`.
+func (p *CloudflareProvider) do(ctx context.Context, method, path string, body interface{}, out interface{}) (*cfResponse, error) {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.opts.BaseURL+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.opts.APIToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var cfResp cfResponse
+	if err := json.NewDecoder(resp.Body).Decode(&cfResp); err != nil {
+		return nil, fmt.Errorf("error decoding response (status %d): %w", resp.StatusCode, err)
+	}
+
+	if !cfResp.Success || resp.StatusCode >= http.StatusBadRequest {
+		msgs := make([]string, 0, len(cfResp.Errors))
+		for _, e := range cfResp.Errors {
+			msgs = append(msgs, fmt.Sprintf("%d: %s", e.Code, e.Message))
+		}
+		return nil, fmt.Errorf("cloudflare api error (status %d): %s", resp.StatusCode, strings.Join(msgs, ", "))
+	}
+
+	if out != nil && len(cfResp.Result) > 0 {
+		if err := json.Unmarshal(cfResp.Result, out); err != nil {
+			return nil, fmt.Errorf("error decoding result: %w", err)
+		}
+	}
+	return &cfResp, nil
+}
+
+// Interface guards
+var (
+	_ DNSProvider = (*CloudflareProvider)(nil)
+)
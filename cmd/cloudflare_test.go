@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCloudflare is an in-memory stand-in for the Cloudflare DNS API.
+type fakeCloudflare struct {
+	sync.Mutex
+	zones   map[string]string // zone name -> zone ID
+	records map[string]cfRecord
+	nextID  int
+}
+
+func newFakeCloudflare() *fakeCloudflare {
+	return &fakeCloudflare{
+		zones:   map[string]string{"test.internal": "zone-1"},
+		records: make(map[string]cfRecord),
+	}
+}
+
+func (f *fakeCloudflare) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "errors": []cfError{{Code: 9109, Message: "Unauthorized"}}})
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "zones":
+		zones := []cfZone{}
+		if id, ok := f.zones[r.URL.Query().Get("name")]; ok {
+			zones = append(zones, cfZone{ID: id, Name: r.URL.Query().Get("name")})
+		}
+		f.respond(w, zones, 1)
+
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		records := []cfRecord{}
+		for _, rec := range f.records {
+			if n := r.URL.Query().Get("name"); n != "" && rec.Name != n {
+				continue
+			}
+			if t := r.URL.Query().Get("type"); t != "" && rec.Type != t {
+				continue
+			}
+			records = append(records, rec)
+		}
+		sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+		f.respond(w, records, 1)
+
+	case len(parts) == 3 && r.Method == http.MethodPost:
+		var rec cfRecord
+		_ = json.NewDecoder(r.Body).Decode(&rec)
+		if !f.validTTL(w, rec) {
+			return
+		}
+		f.nextID++
+		rec.ID = fmt.Sprintf("rec-%d", f.nextID)
+		f.records[rec.ID] = rec
+		f.respond(w, rec, 0)
+
+	case len(parts) == 4 && r.Method == http.MethodPut:
+		var rec cfRecord
+		_ = json.NewDecoder(r.Body).Decode(&rec)
+		if !f.validTTL(w, rec) {
+			return
+		}
+		rec.ID = parts[3]
+		f.records[rec.ID] = rec
+		f.respond(w, rec, 0)
+
+	case len(parts) == 4 && r.Method == http.MethodDelete:
+		delete(f.records, parts[3])
+		f.respond(w, map[string]string{"id": parts[3]}, 0)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "errors": []cfError{{Code: 7003, Message: "Not found"}}})
+	}
+}
+
+// validTTL checks the TTL of a record like Cloudflare does, which only accepts automatic or at least 60 seconds.
+func (f *fakeCloudflare) validTTL(w http.ResponseWriter, rec cfRecord) bool {
+	if rec.TTL == cloudflareAutoTTL || rec.TTL >= cloudflareMinTTL {
+		return true
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "errors": []cfError{{Code: 9021, Message: "Invalid TTL. Must be between 60 and 86400 seconds, or 1 for Automatic."}}})
+	return false
+}
+
+func (f *fakeCloudflare) respond(w http.ResponseWriter, result interface{}, pages int) {
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"result":      result,
+		"result_info": map[string]int{"page": 1, "total_pages": pages},
+	})
+}
+
+func newTestCloudflare(t *testing.T) (*CloudflareProvider, *fakeCloudflare) {
+	fake := newFakeCloudflare()
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	p, err := NewCloudflareProvider(cloudflareOpts{APIToken: "token", BaseURL: srv.URL})
+	require.NoError(t, err)
+	return p, fake
+}
+
+func TestCloudflareSetRecords(t *testing.T) {
+	p, fake := newTestCloudflare(t)
+	ctx := context.Background()
+
+	_, err := p.SetRecords(withProxied(ctx, true), "test.internal.", []libdns.Record{
+		{Type: "A", Name: "redis", Value: "10.0.0.1,10.0.0.2", TTL: 30 * time.Second},
+		{Type: "TXT", Name: "redis", Value: "owner=test", TTL: 30 * time.Second},
+	})
+	require.NoError(t, err)
+	require.Len(t, fake.records, 3)
+
+	for _, rec := range fake.records {
+		assert.Equal(t, "redis.test.internal", rec.Name)
+		if rec.Type == "A" {
+			require.NotNil(t, rec.Proxied)
+			assert.True(t, *rec.Proxied)
+			assert.Equal(t, cloudflareAutoTTL, rec.TTL)
+		} else {
+			assert.Nil(t, rec.Proxied)
+			assert.Equal(t, cloudflareMinTTL, rec.TTL)
+		}
+	}
+
+	// Shrinking the record set must remove the left over value.
+	_, err = p.SetRecords(ctx, "test.internal.", []libdns.Record{
+		{Type: "A", Name: "redis", Value: "10.0.0.3", TTL: 60 * time.Second},
+	})
+	require.NoError(t, err)
+
+	records, err := p.GetRecords(ctx, "test.internal.")
+	require.NoError(t, err)
+
+	var values []string
+	for _, r := range records {
+		assert.Equal(t, "redis.test.internal.", r.Name)
+		if r.Type == "A" {
+			values = append(values, r.Value)
+			assert.Equal(t, 60*time.Second, r.TTL)
+		}
+	}
+	assert.Equal(t, []string{"10.0.0.3"}, values)
+}
+
+func TestCloudflareDefaultTTL(t *testing.T) {
+	p, fake := newTestCloudflare(t)
+	app := newCLITestApp(&memProvider{})
+	app.providers = []providerInstance{{name: "cloudflare", provider: p, domains: []string{"test.internal"}}}
+
+	// Records without a `ttl` tag get the default TTL, which is below the minimum of Cloudflare.
+	svc := ServiceMeta{
+		Name:      "redis",
+		Namespace: "default",
+		Cluster:   "default",
+		DNSName:   "redis.test.internal",
+		Addresses: []string{"10.0.0.1"},
+		Tags:      []string{"external-dns/hostname=redis.test.internal"},
+	}
+	require.NoError(t, app.updateRecords(context.Background(), map[string]ServiceMeta{"redis.test.internal.": svc}, app.opts.domains))
+	require.Len(t, fake.records, 2)
+	for _, rec := range fake.records {
+		assert.Equal(t, cloudflareMinTTL, rec.TTL)
+	}
+
+	// The records are planned with the raised TTL, so they aren't updated again.
+	app.sources[0].synced = true
+	app.services = map[string]ServiceMeta{"redis.test.internal.": svc}
+	require.NoError(t, app.cleanupRecords(context.Background()))
+	assert.True(t, app.inspect.prunePlans["cloudflare"].plan.isEmpty())
+}
+
+func TestCloudflareSRVRecords(t *testing.T) {
+	p, fake := newTestCloudflare(t)
+	ctx := context.Background()
+
+	_, err := p.SetRecords(ctx, "test.internal.", []libdns.Record{
+		{Type: "SRV", Name: "_redis._tcp.redis", Value: "10 5 6379 abcd1234.redis.test.internal.", TTL: 30 * time.Second},
+	})
+	require.NoError(t, err)
+	require.Len(t, fake.records, 1)
+	for _, rec := range fake.records {
+		assert.Equal(t, &cfSRVData{Priority: 10, Weight: 5, Port: 6379, Target: "abcd1234.redis.test.internal"}, rec.Data)
+	}
+
+	records, err := p.GetRecords(ctx, "test.internal.")
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "10 5 6379 abcd1234.redis.test.internal.", records[0].Value)
+
+	_, err = p.DeleteRecords(ctx, "test.internal.", []libdns.Record{
+		{Type: "SRV", Name: "_redis._tcp.redis.", Value: records[0].Value},
+	})
+	require.NoError(t, err)
+	assert.Empty(t, fake.records)
+}
+
+func TestCloudflareDeleteRecords(t *testing.T) {
+	p, fake := newTestCloudflare(t)
+	ctx := context.Background()
+
+	_, err := p.AppendRecords(ctx, "test.internal.", []libdns.Record{
+		{Type: "A", Name: "redis", Value: "10.0.0.1,10.0.0.2", TTL: 30 * time.Second},
+		{Type: "A", Name: "web", Value: "10.0.0.5", TTL: 30 * time.Second},
+	})
+	require.NoError(t, err)
+	require.Len(t, fake.records, 3)
+
+	// Names relative to the zone, as produced by the pruner, must be resolved.
+	deleted, err := p.DeleteRecords(ctx, "test.internal.", []libdns.Record{
+		{Type: "A", Name: "redis.", Value: "10.0.0.1,10.0.0.2"},
+	})
+	require.NoError(t, err)
+	assert.Len(t, deleted, 2)
+	require.Len(t, fake.records, 1)
+	for _, rec := range fake.records {
+		assert.Equal(t, "web.test.internal", rec.Name)
+	}
+}
+
+func TestCloudflareErrors(t *testing.T) {
+	p, _ := newTestCloudflare(t)
+
+	_, err := p.GetRecords(context.Background(), "unknown.internal.")
+	assert.ErrorContains(t, err, "not found")
+
+	p.opts.APIToken = "invalid"
+	_, err = p.GetRecords(context.Background(), "test.internal.")
+	assert.ErrorContains(t, err, "Unauthorized")
+
+	_, err = NewCloudflareProvider(cloudflareOpts{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/libdns/libdns"
+)
+
+const (
+	actionCreate = "create"
+	actionUpdate = "update"
+	actionDelete = "delete"
+)
+
+// plannedChanges keeps the changes planned in dry run mode. As they're never applied, the same changes
+// are planned again at every sync and prune, and are only counted the first time.
+type plannedChanges struct {
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+// add records a planned change and checks if it wasn't planned before.
+func (p *plannedChanges) add(action string, ch Change) bool {
+	k := keyOf(ch.Record, ch.Zone)
+	key := fmt.Sprintf("%s|%s|%s|%s|%s", action, k.name, k.typ, canonicalValue(ch.Record), canonicalValue(ch.Previous))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.seen == nil {
+		p.seen = make(map[string]struct{})
+	}
+	if _, ok := p.seen[key]; ok {
+		return false
+	}
+	p.seen[key] = struct{}{}
+	return true
+}
+
+// canonicalValue returns the values of a record set in a canonical form and order.
+func canonicalValue(r libdns.Record) string {
+	values := normalizeValues(r.Type, r.Value)
+	sort.Strings(values)
+	return strings.Join(values, ",")
+}
+
+// logDryRun logs the changes of a plan which would have been sent to the DNS provider
+// and counts the distinct ones in the dry run metrics.
+func (app *App) logDryRun(plan Plan) {
+	if plan.isEmpty() {
+		return
+	}
+
+	app.lo.Info("Dry run: computed plan, no changes are sent to the DNS provider",
+		"creates", len(plan.Creates), "updates", len(plan.Updates), "deletes", len(plan.Deletes))
+
+	for _, c := range []struct {
+		action  string
+		changes []Change
+	}{
+		{actionCreate, plan.Creates},
+		{actionUpdate, plan.Updates},
+		{actionDelete, plan.Deletes},
+	} {
+		for _, ch := range c.changes {
+			if c.action == actionUpdate {
+				app.lo.Info("Dry run: planned change", "action", c.action, "zone", ch.Zone, "record", ch.Record, "previous", ch.Previous)
+			} else {
+				app.lo.Info("Dry run: planned change", "action", c.action, "zone", ch.Zone, "record", ch.Record)
+			}
+			if app.dryRunChanges.add(c.action, ch) {
+				incDryRunChanges(c.action, ch.Zone)
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlannedChanges(t *testing.T) {
+	var p plannedChanges
+
+	create := Change{Zone: "test.internal.", Record: libdns.Record{Type: "A", Name: "redis", Value: "10.0.0.1", TTL: 30 * time.Second}}
+	assert.True(t, p.add(actionCreate, create))
+
+	// The same change planned again by the next sync, or by the prune in the format of the provider, isn't counted.
+	assert.False(t, p.add(actionCreate, create))
+	assert.False(t, p.add(actionCreate, Change{Zone: "test.internal.", Record: libdns.Record{Type: "A", Name: "redis.test.internal.", Value: "10.0.0.1"}}))
+
+	// A different value or action is a new change.
+	create.Record.Value = "10.0.0.2"
+	assert.True(t, p.add(actionCreate, create))
+	assert.True(t, p.add(actionDelete, create))
+}
+
+// readOnlyProvider is a DNSProvider which serves records from memory, and fails the test on any call which changes them.
+type readOnlyProvider struct {
+	*memProvider
+	t *testing.T
+}
+
+func (p readOnlyProvider) AppendRecords(_ context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	p.t.Errorf("records appended in dry run mode: %s %v", zone, recs)
+	return nil, nil
+}
+
+func (p readOnlyProvider) SetRecords(_ context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	p.t.Errorf("records set in dry run mode: %s %v", zone, recs)
+	return nil, nil
+}
+
+func (p readOnlyProvider) DeleteRecords(_ context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	p.t.Errorf("records deleted in dry run mode: %s %v", zone, recs)
+	return nil, nil
+}
+
+func TestDryRunDoesntChangeRecords(t *testing.T) {
+	const zone = "test.internal."
+	service := func(name, addr string) ServiceMeta {
+		return ServiceMeta{
+			Name:      name,
+			Namespace: "default",
+			Cluster:   "default",
+			DNSName:   name + ".test.internal",
+			Addresses: []string{addr},
+			Tags:      []string{"external-dns/hostname=" + name + ".test.internal"},
+		}
+	}
+
+	// `redis` drifted from its service, `gone` is no longer registered, and `web` is new.
+	mem := &memProvider{records: make(map[string][]libdns.Record)}
+	for _, svc := range []ServiceMeta{service("redis", "10.0.0.9"), service("gone", "10.0.0.3")} {
+		record, err := svc.ToRecord([]string{"test.internal"}, "test-owner")
+		require.NoError(t, err)
+		_, err = mem.SetRecords(context.Background(), zone, record.Records)
+		require.NoError(t, err)
+	}
+
+	app := newCLITestApp(mem)
+	app.providers[0].provider = readOnlyProvider{memProvider: mem, t: t}
+	app.opts.dryRun = true
+	app.sources[0].synced = true
+
+	services := map[string]ServiceMeta{
+		"redis.test.internal.": service("redis", "10.0.0.1"),
+		"web.test.internal.":   service("web", "10.0.0.2"),
+	}
+	require.NoError(t, app.updateRecords(context.Background(), services, app.opts.domains))
+	require.NoError(t, app.cleanupRecords(context.Background()))
+
+	// The changes are planned all the same.
+	plan := app.inspect.syncPlan.plan
+	assert.Len(t, plan.Creates, 2, "the A and TXT records of web")
+	assert.Len(t, plan.Updates, 1, "the A record of redis")
+	prune := app.inspect.prunePlans["mem"].plan
+	assert.Len(t, prune.Deletes, 2, "the A and TXT records of gone")
+	assert.Equal(t, []string{"10.0.0.9"}, mem.values(zone, "redis.test.internal.", "A"))
+}
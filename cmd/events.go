@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+const (
+	// eventServiceRegistration is emitted by Nomad when a service instance is registered.
+	eventServiceRegistration = "ServiceRegistration"
+	// eventServiceDeregistration is emitted by Nomad when a service instance is deregistered.
+	eventServiceDeregistration = "ServiceDeregistration"
+	// eventStreamBackoff is the delay before resubscribing to a disconnected event stream.
+	eventStreamBackoff = time.Second * 5
+)
+
+// runEventWatcher spawns a goroutine which subscribes to the event stream of a Nomad source
+// and keeps resubscribing until the context is cancelled.
+func (app *App) runEventWatcher(ctx context.Context, wg *sync.WaitGroup, src *nomadSource) {
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		// Index of the last event processed. Used to resume the stream after a disconnect.
+		var lastIndex uint64
+
+		for {
+			err := app.watchEvents(ctx, src, &lastIndex)
+			if ctx.Err() != nil {
+				app.lo.Warn("Context cancellation received, terminating worker", "worker", "watcher")
+				return
+			}
+
+			app.lo.Error("Event stream disconnected, resubscribing", "source", src.name, "error", err, "index", lastIndex, "backoff", eventStreamBackoff)
+			select {
+			case <-time.After(eventStreamBackoff):
+			case <-ctx.Done():
+				app.lo.Warn("Context cancellation received, terminating worker", "worker", "watcher")
+				return
+			}
+		}
+	}()
+}
+
+// watchEvents subscribes to the Service topic of the Nomad event stream starting from `lastIndex`
+// and reconciles every service for which a registration or deregistration event is received.
+// It blocks until the stream errors out or the context is cancelled.
+func (app *App) watchEvents(ctx context.Context, src *nomadSource, lastIndex *uint64) error {
+	topics := map[api.Topic][]string{
+		api.TopicService: {"*"},
+	}
+
+	eventsCh, err := src.client.EventStream().Stream(ctx, topics, *lastIndex, &api.QueryOptions{Namespace: "*"})
+	if err != nil {
+		return fmt.Errorf("error subscribing to event stream: %w", err)
+	}
+
+	app.lo.Info("Subscribed to Nomad event stream", "source", src.name, "index", *lastIndex)
+
+	// Events may have been missed since the last subscription, so the cache isn't trusted
+	// to be current until the services are fetched again.
+	src.cacheMu.Lock()
+	src.subscription++
+	src.eventIndex = 0
+	src.cacheMu.Unlock()
+
+	for events := range eventsCh {
+		if events.Err != nil {
+			return fmt.Errorf("error reading from event stream: %w", events.Err)
+		}
+
+		for _, event := range events.Events {
+			if event.Type != eventServiceRegistration && event.Type != eventServiceDeregistration {
+				continue
+			}
+
+			svc, err := event.Service()
+			if err != nil || svc == nil {
+				app.lo.Error("Unable to decode service from event", "type", event.Type, "key", event.Key, "error", err)
+				continue
+			}
+
+			app.lo.Debug("Received service event", "type", event.Type, "service", svc.ServiceName, "namespace", svc.Namespace, "index", event.Index)
+			app.reconcileService(ctx, src, svc.Namespace, svc.ServiceName, event.Index)
+		}
+
+		*lastIndex = events.Index
+		src.cacheMu.Lock()
+		src.eventIndex = events.Index
+		src.cacheMu.Unlock()
+	}
+
+	return fmt.Errorf("event stream closed")
+}
+
+// reconcileService fetches the state of a single service as of the given index and
+// syncs only the records belonging to it.
+func (app *App) reconcileService(ctx context.Context, src *nomadSource, namespace, name string, index uint64) {
+	svcMeta, err := app.fetchServiceMeta(ctx, src, namespace, name, index)
+	if err != nil {
+		app.lo.Error("Failed to fetch service", "source", src.name, "service", name, "namespace", namespace, "error", err)
+		// Drop the cached service, as the event is considered handled, so that the next resync fetches it again.
+		src.cacheMu.Lock()
+		delete(src.svcCache, serviceCacheKey(namespace, name))
+		src.cacheMu.Unlock()
+		return
+	}
+
+	var services map[string]ServiceMeta
+	if svcMeta != nil {
+		services = app.filterHealthyServices(ctx, svcMeta.byHostname())
+	}
+
+	// Forget any entry which no longer belongs to this service, so that the pruner can clean it up.
+	app.Lock()
+	for key, s := range app.services {
+		if _, ok := services[key]; !ok && s.Cluster == src.name && s.Namespace == namespace && s.Name == name {
+			app.lo.Info("Service no longer exported, scheduling records for prune", "service", name, "namespace", namespace, "dns", key)
+			delete(app.services, key)
+		}
+	}
+	app.Unlock()
+
+	if len(services) == 0 {
+		return
+	}
+
+	// Errors are logged for every service, and the records are repaired by the next resync or prune.
+	_ = app.updateRecords(ctx, services, app.opts.domains)
+}
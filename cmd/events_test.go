@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/nomad/api"
+	"github.com/libdns/libdns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serviceEvent returns an event of the given type for the registrations of a service, at the index of the fake API.
+func (f *fakeServices) serviceEvent(typ, name string, reg *api.ServiceRegistration) api.Event {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return api.Event{
+		Topic:   api.TopicService,
+		Type:    typ,
+		Key:     name,
+		Index:   f.index,
+		Payload: map[string]interface{}{"Service": reg},
+	}
+}
+
+func TestWatchEvents(t *testing.T) {
+	const zone = "test.internal."
+	var (
+		fake     = &fakeServices{services: make(map[string][]*api.ServiceRegistration), gets: make(map[string]int)}
+		provider = &memProvider{records: make(map[string][]libdns.Record)}
+		app      = newCLITestApp(provider)
+		tags     = []string{"external-dns/hostname=redis.test.internal"}
+	)
+	src := newFakeSource(t, fake)
+	app.sources = []*nomadSource{src}
+	app.opts.annotationPrefix = DefaultAnnotationPrefix
+	app.opts.maxConcurrentFetches = 2
+
+	// A registration event publishes the records of the service. Events of other types
+	// and payloads which can't be decoded are skipped.
+	fake.set("redis", tags, "10.0.0.1")
+	fake.events = []api.Events{{Index: fake.index, Events: []api.Event{
+		{Topic: api.TopicService, Type: "ServiceUpdated", Key: "redis", Index: fake.index},
+		{Topic: api.TopicService, Type: eventServiceRegistration, Key: "broken", Index: fake.index, Payload: map[string]interface{}{"Service": "broken"}},
+		fake.serviceEvent(eventServiceRegistration, "redis", fake.services["redis"][0]),
+	}}}
+
+	var lastIndex uint64
+	err := app.watchEvents(context.Background(), src, &lastIndex)
+	require.Error(t, err, "the stream is closed after the events")
+	assert.Equal(t, []string{"10.0.0.1"}, provider.values(zone, "redis.test.internal.", "A"))
+	assert.Contains(t, app.services, "redis.test.internal.")
+	assert.Equal(t, map[string]int{"redis": 1}, fake.calls())
+	assert.Equal(t, fake.index, lastIndex)
+	assert.Equal(t, 1, src.subscription)
+	assert.Equal(t, fake.index, src.eventIndex)
+
+	// The stream is resumed from the last index. Subscribing again isn't trusted to keep the cache current,
+	// as events may have been missed in between.
+	reg := fake.services["redis"][0]
+	fake.set("redis", nil)
+	fake.events = []api.Events{{Index: fake.index, Events: []api.Event{
+		fake.serviceEvent(eventServiceDeregistration, "redis", reg),
+	}}}
+	err = app.watchEvents(context.Background(), src, &lastIndex)
+	require.Error(t, err)
+	assert.Equal(t, []string{"0", "1"}, fake.streams)
+	assert.Equal(t, 2, src.subscription)
+	assert.Equal(t, fake.index, src.eventIndex)
+
+	// A deregistration forgets the service, so that the next prune deletes its records.
+	assert.NotContains(t, app.services, "redis.test.internal.")
+	assert.Equal(t, []string{"10.0.0.1"}, provider.values(zone, "redis.test.internal.", "A"))
+	src.synced = true
+	require.NoError(t, app.cleanupRecords(context.Background()))
+	assert.Empty(t, provider.values(zone, "redis.test.internal.", "A"))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+	"github.com/knadh/koanf"
+)
+
+const (
+	// nodeClassRefreshInterval is the age after which the cached classes of the nodes are listed again.
+	nodeClassRefreshInterval = time.Minute * 5
+	// unknownNodeRetryInterval is the minimum age of the cached classes before they're listed again for an unknown node.
+	unknownNodeRetryInterval = time.Second * 30
+)
+
+// sourceFilters restricts the services exported from the Nomad cluster.
+// Every filter is a list of glob patterns. An empty include list matches everything
+// and exclusions take precedence over inclusions.
+type sourceFilters struct {
+	namespaces         []string
+	excludeNamespaces  []string
+	datacenters        []string
+	excludeDatacenters []string
+	jobs               []string
+	excludeJobs        []string
+	nodeClasses        []string
+	excludeNodeClasses []string
+}
+
+// initSourceFilters reads the filters from the `nomad.filters` config and validates their patterns.
+func initSourceFilters(ko *koanf.Koanf) (sourceFilters, error) {
+	f := sourceFilters{
+		namespaces:         ko.Strings("nomad.filters.namespaces"),
+		excludeNamespaces:  ko.Strings("nomad.filters.exclude_namespaces"),
+		datacenters:        ko.Strings("nomad.filters.datacenters"),
+		excludeDatacenters: ko.Strings("nomad.filters.exclude_datacenters"),
+		jobs:               ko.Strings("nomad.filters.jobs"),
+		excludeJobs:        ko.Strings("nomad.filters.exclude_jobs"),
+		nodeClasses:        ko.Strings("nomad.filters.node_classes"),
+		excludeNodeClasses: ko.Strings("nomad.filters.exclude_node_classes"),
+	}
+
+	for _, patterns := range [][]string{
+		f.namespaces, f.excludeNamespaces, f.datacenters, f.excludeDatacenters,
+		f.jobs, f.excludeJobs, f.nodeClasses, f.excludeNodeClasses,
+	} {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return sourceFilters{}, fmt.Errorf("invalid filter pattern %q: %w", p, err)
+			}
+		}
+	}
+	return f, nil
+}
+
+// matchNamespace checks if services in the namespace are exported.
+func (f sourceFilters) matchNamespace(namespace string) bool {
+	return matchFilter(namespace, f.namespaces, f.excludeNamespaces)
+}
+
+// filterNodeClasses checks if any node class filter is set, which requires a lookup of the nodes.
+func (f sourceFilters) filterNodeClasses() bool {
+	return len(f.nodeClasses) > 0 || len(f.excludeNodeClasses) > 0
+}
+
+// match checks if a registration is exported, given the class of the node it runs on.
+func (f sourceFilters) match(reg *api.ServiceRegistration, nodeClass string) bool {
+	return matchFilter(reg.Namespace, f.namespaces, f.excludeNamespaces) &&
+		matchFilter(reg.Datacenter, f.datacenters, f.excludeDatacenters) &&
+		matchFilter(reg.JobID, f.jobs, f.excludeJobs) &&
+		matchFilter(nodeClass, f.nodeClasses, f.excludeNodeClasses)
+}
+
+// matchFilter checks if the value matches any of the include patterns (or there are none)
+// and none of the exclude patterns.
+func matchFilter(value string, include, exclude []string) bool {
+	for _, p := range exclude {
+		if ok, _ := path.Match(p, value); ok {
+			return false
+		}
+	}
+	if len(include) == 0 {
+		return true
+	}
+	for _, p := range include {
+		if ok, _ := path.Match(p, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// filterRegistrations returns the registrations of a service which pass the source filters.
+// Services whose registrations are all filtered out are treated as absent, so their records are pruned.
+func (app *App) filterRegistrations(ctx context.Context, src *nomadSource, svcRegistrations []*api.ServiceRegistration) ([]*api.ServiceRegistration, error) {
+	filtered := make([]*api.ServiceRegistration, 0, len(svcRegistrations))
+	for _, reg := range svcRegistrations {
+		var nodeClass string
+		if app.opts.filters.filterNodeClasses() {
+			class, err := src.nodeClass(ctx, reg.NodeID)
+			if err != nil {
+				return nil, err
+			}
+			nodeClass = class
+		}
+		if app.opts.filters.match(reg, nodeClass) {
+			filtered = append(filtered, reg)
+		}
+	}
+	return filtered, nil
+}
+
+// nodeClass returns the class of a Nomad node. The classes of all nodes are listed at once and cached.
+// The list is refreshed once it's older than nodeClassRefreshInterval, so that changed classes are picked up,
+// or when an unknown node is seen, at most once per unknownNodeRetryInterval so that a node which
+// isn't known to Nomad doesn't list all the nodes for every registration.
+func (src *nomadSource) nodeClass(ctx context.Context, nodeID string) (string, error) {
+	src.cacheMu.Lock()
+	class, ok := src.nodeClasses[nodeID]
+	age := time.Since(src.nodesListedAt)
+	src.cacheMu.Unlock()
+	if age < nodeClassRefreshInterval && (ok || age < unknownNodeRetryInterval) {
+		return class, nil
+	}
+
+	q := &api.QueryOptions{}
+	nodes, _, err := src.client.Nodes().List(q.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("error listing nodes: %w", err)
+	}
+
+	classes := make(map[string]string, len(nodes))
+	for _, n := range nodes {
+		classes[n.ID] = n.NodeClass
+	}
+
+	src.cacheMu.Lock()
+	src.nodeClasses = classes
+	src.nodesListedAt = time.Now()
+	src.cacheMu.Unlock()
+
+	return classes[nodeID], nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceFilters(t *testing.T) {
+	f := sourceFilters{
+		excludeNamespaces: []string{"kube-*"},
+		datacenters:       []string{"dc1", "dc2"},
+		jobs:              []string{"web-*", "batch/*"},
+		excludeJobs:       []string{"web-canary"},
+		nodeClasses:       []string{"public"},
+	}
+
+	tests := []struct {
+		name      string
+		reg       *api.ServiceRegistration
+		nodeClass string
+		want      bool
+	}{
+		{
+			name:      "matches all filters",
+			reg:       &api.ServiceRegistration{Namespace: "default", Datacenter: "dc1", JobID: "web-api"},
+			nodeClass: "public",
+			want:      true,
+		},
+		{
+			name:      "job with a slash",
+			reg:       &api.ServiceRegistration{Namespace: "default", Datacenter: "dc2", JobID: "batch/dispatch-123"},
+			nodeClass: "public",
+			want:      true,
+		},
+		{
+			name:      "excluded namespace",
+			reg:       &api.ServiceRegistration{Namespace: "kube-system", Datacenter: "dc1", JobID: "web-api"},
+			nodeClass: "public",
+		},
+		{
+			name:      "datacenter not included",
+			reg:       &api.ServiceRegistration{Namespace: "default", Datacenter: "dc3", JobID: "web-api"},
+			nodeClass: "public",
+		},
+		{
+			name:      "exclusion takes precedence",
+			reg:       &api.ServiceRegistration{Namespace: "default", Datacenter: "dc1", JobID: "web-canary"},
+			nodeClass: "public",
+		},
+		{
+			name: "node class not included",
+			reg:  &api.ServiceRegistration{Namespace: "default", Datacenter: "dc1", JobID: "web-api"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, f.match(tt.reg, tt.nodeClass))
+		})
+	}
+
+	// No filters match everything.
+	assert.True(t, sourceFilters{}.match(&api.ServiceRegistration{Namespace: "default"}, ""))
+}
+
+func TestNodeClass(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		lists int
+		nodes = []*api.NodeListStub{{ID: "node-1", NodeClass: "public"}}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		lists++
+		_ = json.NewEncoder(w).Encode(nodes)
+	}))
+	defer srv.Close()
+
+	client, err := api.NewClient(&api.Config{Address: srv.URL})
+	require.NoError(t, err)
+	src := newNomadSource("default", "", client)
+	ctx := context.Background()
+
+	classOf := func(nodeID string) string {
+		class, err := src.nodeClass(ctx, nodeID)
+		require.NoError(t, err)
+		return class
+	}
+	listed := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		n := lists
+		lists = 0
+		return n
+	}
+
+	// The nodes are listed once, and unknown nodes don't list them again until the retry interval passed.
+	assert.Equal(t, "public", classOf("node-1"))
+	assert.Equal(t, "", classOf("node-2"))
+	assert.Equal(t, "", classOf("node-2"))
+	assert.Equal(t, 1, listed())
+
+	mu.Lock()
+	nodes = append(nodes, &api.NodeListStub{ID: "node-2", NodeClass: "private"})
+	mu.Unlock()
+	src.nodesListedAt = time.Now().Add(-unknownNodeRetryInterval)
+	assert.Equal(t, "private", classOf("node-2"))
+	assert.Equal(t, "public", classOf("node-1"))
+	assert.Equal(t, 1, listed())
+
+	// Known nodes are listed again once the cache is older than the refresh interval.
+	mu.Lock()
+	nodes[0].NodeClass = "batch"
+	mu.Unlock()
+	assert.Equal(t, "public", classOf("node-1"))
+	src.nodesListedAt = time.Now().Add(-nodeClassRefreshInterval)
+	assert.Equal(t, "batch", classOf("node-1"))
+	assert.Equal(t, 1, listed())
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// defaultPruneMinOwned is the number of owned record sets below which the percentage threshold doesn't apply, if unset.
+const defaultPruneMinOwned = 10
+
+// deletionGuard protects the owned records from being deleted when the services are missing for a short while,
+// e.g. when the Nomad API briefly returns an empty list of services.
+// Deletions are held back until a record set has been absent for long enough, and a prune is refused
+// altogether if it would delete too many of the owned records at once.
+type deletionGuard struct {
+	// maxPercent is the largest percentage of the owned record sets of a provider which can be deleted in one prune.
+	maxPercent float64
+	// minOwned is the number of owned record sets from which maxPercent applies. In small zones, removing
+	// a single service deletes a large share of the records, which would otherwise trip the guard for good.
+	minOwned int
+	// maxCount is the largest number of record sets which can be deleted in one prune.
+	maxCount int
+	// graceCycles is the number of consecutive prunes a record set has to be absent from the services for.
+	graceCycles int
+	// gracePeriod is the duration a record set has to be absent from the services for.
+	gracePeriod time.Duration
+	// oneShot is set in the one-shot commands, which can't observe a record set to be absent over several prunes.
+	// Instead of the grace period, deletions are refused unless they're confirmed.
+	oneShot bool
+	// confirmed is set when the deletions of a one-shot command are confirmed, e.g. with `--force`.
+	confirmed bool
+
+	// absent tracks the record sets which are absent from the services, by zone, name and type.
+	absent map[string]absence
+}
+
+// absence is when a record set was first found to be absent and in how many consecutive prunes.
+type absence struct {
+	zone   string
+	since  time.Time
+	cycles int
+}
+
+// due records the deletes of a prune of the given (fully qualified) zones as absent and returns the ones which have been absent
+// for at least graceCycles prunes and gracePeriod. Record sets of the zones which are no longer absent are forgotten,
+// so a record set has to be absent again for the whole grace period before it's deleted.
+func (g *deletionGuard) due(deletes []Change, zones []string, now time.Time) []Change {
+	if g.absent == nil {
+		g.absent = make(map[string]absence)
+	}
+
+	var (
+		due     = make([]Change, 0, len(deletes))
+		current = make(map[string]struct{}, len(deletes))
+	)
+	for _, d := range deletes {
+		key := absenceKey(d)
+		current[key] = struct{}{}
+
+		a, ok := g.absent[key]
+		if !ok {
+			a = absence{zone: d.Zone, since: now}
+		}
+		a.cycles++
+		g.absent[key] = a
+
+		if a.cycles >= g.graceCycles && now.Sub(a.since) >= g.gracePeriod {
+			due = append(due, d)
+		}
+	}
+
+	for key, a := range g.absent {
+		if _, ok := current[key]; !ok && Contains(zones, a.zone) {
+			delete(g.absent, key)
+		}
+	}
+	return due
+}
+
+// check returns an error if deleting the given number of record sets out of the owned ones exceeds the thresholds.
+func (g *deletionGuard) check(deletes, owned int) error {
+	if g.maxCount > 0 && deletes > g.maxCount {
+		return fmt.Errorf("%d record sets would be deleted, more than the maximum of %d", deletes, g.maxCount)
+	}
+	if g.maxPercent > 0 && owned > 0 && owned >= g.minOwned {
+		if percent := float64(deletes) * 100 / float64(owned); percent > g.maxPercent {
+			return fmt.Errorf("%.1f%% of the %d owned record sets would be deleted, more than the maximum of %.1f%%", percent, owned, g.maxPercent)
+		}
+	}
+	return nil
+}
+
+// absenceKey returns the key of the record set of a change, prefixed with its zone.
+func absenceKey(c Change) string {
+	key := keyOf(c.Record, c.Zone)
+	return c.Zone + "/" + key.name + "/" + key.typ
+}
+
+// guardDeletes returns the deletes of a prune of a provider which are allowed by the deletion guard.
+// If the deletes which are due exceed the thresholds, none of them are returned and the prune of the provider
+// only creates and updates records. In one-shot commands, none of them are returned unless they're confirmed.
+func (app *App) guardDeletes(p providerInstance, deletes []Change, owned int) []Change {
+	due := deletes
+	if app.guard.oneShot {
+		if !app.guard.confirmed && len(deletes) > 0 {
+			app.lo.Warn("Refusing to delete records without confirmation, run with --force to delete them", "provider", p.name, "count", len(deletes))
+			return nil
+		}
+	} else {
+		zones := make([]string, 0, len(p.domains))
+		for _, d := range p.domains {
+			zones = append(zones, EnsureFQDN(d))
+		}
+
+		due = app.guard.due(deletes, zones, time.Now())
+		if held := len(deletes) - len(due); held > 0 {
+			app.lo.Info("Holding back deletion of records absent for less than the grace period", "provider", p.name, "count", held)
+		}
+	}
+
+	if err := app.guard.check(len(due), owned); err != nil {
+		app.lo.Error("Refusing to delete records, deletion threshold exceeded", "provider", p.name, "error", err)
+		incPruneGuardTripped(p.name)
+		return nil
+	}
+	return due
+}
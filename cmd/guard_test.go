@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slog"
+)
+
+func TestDeletionGuardDue(t *testing.T) {
+	var (
+		now   = time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)
+		web   = Change{Zone: "test.internal.", Record: libdns.Record{Type: "A", Name: "web.", Value: "10.0.0.1"}}
+		api   = Change{Zone: "test.internal.", Record: libdns.Record{Type: "A", Name: "api.", Value: "10.0.0.2"}}
+		other = Change{Zone: "example.com.", Record: libdns.Record{Type: "A", Name: "www.", Value: "10.0.0.3"}}
+		zones = []string{"test.internal."}
+	)
+
+	t.Run("no grace", func(t *testing.T) {
+		g := &deletionGuard{}
+		assert.Equal(t, []Change{web}, g.due([]Change{web}, zones, now))
+	})
+
+	t.Run("grace cycles", func(t *testing.T) {
+		g := &deletionGuard{graceCycles: 3}
+		assert.Empty(t, g.due([]Change{web}, zones, now))
+		assert.Empty(t, g.due([]Change{web, api}, zones, now))
+		assert.Equal(t, []Change{web}, g.due([]Change{web, api}, zones, now))
+		assert.Equal(t, []Change{web, api}, g.due([]Change{web, api}, zones, now))
+	})
+
+	t.Run("grace period", func(t *testing.T) {
+		g := &deletionGuard{gracePeriod: 10 * time.Minute}
+		assert.Empty(t, g.due([]Change{web}, zones, now))
+		assert.Empty(t, g.due([]Change{web}, zones, now.Add(5*time.Minute)))
+		assert.Equal(t, []Change{web}, g.due([]Change{web}, zones, now.Add(10*time.Minute)))
+	})
+
+	t.Run("reappearing record starts over", func(t *testing.T) {
+		g := &deletionGuard{graceCycles: 2}
+		assert.Empty(t, g.due([]Change{web}, zones, now))
+		// The service is back in the next cycle.
+		assert.Empty(t, g.due(nil, zones, now))
+		assert.Empty(t, g.due([]Change{web}, zones, now))
+		assert.Equal(t, []Change{web}, g.due([]Change{web}, zones, now))
+	})
+
+	t.Run("zones of other providers are kept", func(t *testing.T) {
+		g := &deletionGuard{graceCycles: 2}
+		assert.Empty(t, g.due([]Change{other}, []string{"example.com."}, now))
+		assert.Empty(t, g.due(nil, zones, now))
+		assert.Equal(t, []Change{other}, g.due([]Change{other}, []string{"example.com."}, now))
+	})
+}
+
+func TestDeletionGuardCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		guard   deletionGuard
+		deletes int
+		owned   int
+		wantErr bool
+	}{
+		{name: "no thresholds", guard: deletionGuard{}, deletes: 10, owned: 10},
+		{name: "within count", guard: deletionGuard{maxCount: 5}, deletes: 5, owned: 10},
+		{name: "exceeds count", guard: deletionGuard{maxCount: 5}, deletes: 6, owned: 10, wantErr: true},
+		{name: "within percent", guard: deletionGuard{maxPercent: 50}, deletes: 5, owned: 10},
+		{name: "exceeds percent", guard: deletionGuard{maxPercent: 50}, deletes: 6, owned: 10, wantErr: true},
+		{name: "all records", guard: deletionGuard{maxPercent: 50, maxCount: 100}, deletes: 10, owned: 10, wantErr: true},
+		{name: "nothing owned", guard: deletionGuard{maxPercent: 50}, deletes: 0, owned: 0},
+		{name: "below min owned", guard: deletionGuard{maxPercent: 50, minOwned: 10}, deletes: 2, owned: 2},
+		{name: "at min owned", guard: deletionGuard{maxPercent: 50, minOwned: 10}, deletes: 6, owned: 10, wantErr: true},
+		{name: "count below min owned", guard: deletionGuard{maxCount: 1, minOwned: 10}, deletes: 2, owned: 2, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.guard.check(tt.deletes, tt.owned)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestGuardDeletesOneShot(t *testing.T) {
+	var (
+		p       = providerInstance{name: "mem", domains: []string{"test.internal"}}
+		web     = Change{Zone: "test.internal.", Record: libdns.Record{Type: "A", Name: "web.", Value: "10.0.0.1"}}
+		api     = Change{Zone: "test.internal.", Record: libdns.Record{Type: "A", Name: "api.", Value: "10.0.0.2"}}
+		deletes = []Change{web, api}
+	)
+	newApp := func(guard deletionGuard) *App {
+		return &App{lo: slog.New(slog.NewTextHandler(io.Discard, nil)), guard: guard}
+	}
+
+	// The deletes are refused without confirmation, even when the guard isn't configured.
+	app := newApp(deletionGuard{oneShot: true})
+	assert.Empty(t, app.guardDeletes(p, deletes, 2))
+
+	// Once confirmed, the grace period doesn't hold them back, as it can't be observed in a single run.
+	app = newApp(deletionGuard{oneShot: true, confirmed: true, graceCycles: 2, gracePeriod: time.Hour})
+	assert.Equal(t, deletes, app.guardDeletes(p, deletes, 2))
+
+	// The thresholds still apply.
+	app = newApp(deletionGuard{oneShot: true, confirmed: true, maxCount: 1})
+	assert.Empty(t, app.guardDeletes(p, deletes, 20))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// checkStatusSuccess is the status of a passing Nomad service check.
+const checkStatusSuccess = "success"
+
+// healthCheckEnabled checks if only the allocations with passing checks should be published for the service.
+// The HealthyOnlyAnnotationKey annotation overrides the global setting.
+func (s *ServiceMeta) healthCheckEnabled(global bool) bool {
+	if v, ok := s.Annotations.get(HealthyOnlyAnnotationKey); ok {
+		if enabled, err := strconv.ParseBool(v); err == nil {
+			return enabled
+		}
+	}
+	return global
+}
+
+// filterHealthyServices returns the services with only the addresses and endpoints of allocations
+// whose checks are passing, for services which have health checking enabled.
+// The check status isn't part of the service registration, so it's queried for every allocation on each call.
+func (app *App) filterHealthyServices(ctx context.Context, services map[string]ServiceMeta) map[string]ServiceMeta {
+	// Collect the allocations of all the services which need to be checked, along with their source.
+	allocs := make(map[string]*nomadSource)
+	for _, svc := range services {
+		if !svc.healthCheckEnabled(app.opts.healthyOnly) {
+			continue
+		}
+		src := app.sourceByName(svc.Cluster)
+		if src == nil {
+			continue
+		}
+		for _, e := range svc.Endpoints {
+			allocs[e.AllocID] = src
+		}
+	}
+	if len(allocs) == 0 {
+		return services
+	}
+
+	checks := app.fetchAllocChecks(ctx, allocs)
+
+	filtered := make(map[string]ServiceMeta, len(services))
+	for key, svc := range services {
+		if svc.healthCheckEnabled(app.opts.healthyOnly) {
+			svc = healthyService(svc, checks, app.opts.healthyFailOpen)
+		}
+		filtered[key] = svc
+	}
+	return filtered
+}
+
+// fetchAllocChecks fetches the status of the checks of the given allocations, with a bounded concurrency.
+// Allocations whose checks couldn't be fetched are left out of the result.
+func (app *App) fetchAllocChecks(ctx context.Context, allocs map[string]*nomadSource) map[string]api.AllocCheckStatuses {
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		sem    = make(chan struct{}, app.opts.maxConcurrentFetches)
+		checks = make(map[string]api.AllocCheckStatuses, len(allocs))
+	)
+	for allocID, src := range allocs {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(allocID string, src *nomadSource) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			q := &api.QueryOptions{}
+			statuses, err := src.client.Allocations().Checks(allocID, q.WithContext(ctx))
+			if err != nil {
+				app.lo.Error("Failed to fetch allocation checks", "source", src.name, "alloc", allocID, "error", err)
+				return
+			}
+
+			mu.Lock()
+			checks[allocID] = statuses
+			mu.Unlock()
+		}(allocID, src)
+	}
+	wg.Wait()
+
+	return checks
+}
+
+// healthyService returns a copy of the service with only the endpoints of allocations whose checks are passing.
+// Allocations without a known check status are kept, so that a failure to query Nomad doesn't withdraw records.
+// If none of the allocations are healthy, the service is marked as unhealthy. Its records are withdrawn,
+// unless `failOpen` is set, in which case all of its allocations are kept.
+func healthyService(svc ServiceMeta, checks map[string]api.AllocCheckStatuses, failOpen bool) ServiceMeta {
+	var (
+		endpoints = make([]Endpoint, 0, len(svc.Endpoints))
+		addresses = make([]string, 0, len(svc.Addresses))
+	)
+	for _, e := range svc.Endpoints {
+		if statuses, ok := checks[e.AllocID]; ok && !checksPassing(svc.Name, statuses) {
+			continue
+		}
+		endpoints = append(endpoints, e)
+		if !Contains(addresses, e.Address) {
+			addresses = append(addresses, e.Address)
+		}
+	}
+
+	if len(endpoints) == 0 && len(svc.Endpoints) > 0 {
+		svc.Unhealthy = true
+		if failOpen {
+			return svc
+		}
+	}
+	svc.Endpoints = endpoints
+	svc.Addresses = addresses
+	return svc
+}
+
+// checksPassing checks if all the checks of a service within an allocation are passing.
+// A service without any checks is considered healthy.
+func checksPassing(service string, statuses api.AllocCheckStatuses) bool {
+	for _, c := range statuses {
+		if c.Service == service && c.Status != checkStatusSuccess {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hashicorp/nomad/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthyService(t *testing.T) {
+	svc := ServiceMeta{
+		Name:      "web",
+		Addresses: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+		Endpoints: []Endpoint{
+			{AllocID: "alloc-1", Address: "10.0.0.1", Port: 8080},
+			{AllocID: "alloc-2", Address: "10.0.0.2", Port: 8080},
+			{AllocID: "alloc-3", Address: "10.0.0.3", Port: 8080},
+			{AllocID: "alloc-4", Address: "10.0.0.3", Port: 8081},
+		},
+	}
+	checks := map[string]api.AllocCheckStatuses{
+		"alloc-1": {
+			"c1": {Service: "web", Status: "success"},
+			"c2": {Service: "other", Status: "failure"}, // Check of another service in the same allocation.
+		},
+		"alloc-2": {
+			"c1": {Service: "web", Status: "success"},
+			"c2": {Service: "web", Status: "pending"},
+		},
+		"alloc-3": {
+			"c1": {Service: "web", Status: "failure"},
+		},
+		// The status of alloc-4 is unknown.
+	}
+
+	got := healthyService(svc, checks, false)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.3"}, got.Addresses)
+	assert.Equal(t, []Endpoint{
+		{AllocID: "alloc-1", Address: "10.0.0.1", Port: 8080},
+		{AllocID: "alloc-4", Address: "10.0.0.3", Port: 8081},
+	}, got.Endpoints)
+	assert.False(t, got.Unhealthy)
+
+	// The original service must be left untouched.
+	assert.Len(t, svc.Endpoints, 4)
+
+	// Without any healthy allocation, the addresses are withdrawn, or all of them are kept when failing open.
+	checks["alloc-1"] = api.AllocCheckStatuses{"c1": {Service: "web", Status: "failure"}}
+	checks["alloc-4"] = api.AllocCheckStatuses{"c1": {Service: "web", Status: "failure"}}
+	got = healthyService(svc, checks, false)
+	assert.True(t, got.Unhealthy)
+	assert.Empty(t, got.Addresses)
+	assert.Empty(t, got.Endpoints)
+
+	got = healthyService(svc, checks, true)
+	assert.True(t, got.Unhealthy)
+	assert.Equal(t, svc.Addresses, got.Addresses)
+	assert.Equal(t, svc.Endpoints, got.Endpoints)
+}
+
+func TestHealthCheckEnabled(t *testing.T) {
+	svc := ServiceMeta{Annotations: annotations{"hostname": {"web.test.internal"}}}
+	assert.False(t, svc.healthCheckEnabled(false))
+	assert.True(t, svc.healthCheckEnabled(true))
+
+	svc.Annotations["healthy-only"] = []string{"false"}
+	assert.False(t, svc.healthCheckEnabled(true))
+
+	svc.Annotations = annotations{"healthy-only": {"true"}}
+	assert.True(t, svc.healthCheckEnabled(false))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// httpShutdownTimeout is the time given to in-flight requests to finish when the HTTP server is stopped.
+const httpShutdownTimeout = time.Second * 5
+
+// runHTTPServer spawns a goroutine which serves the metrics, the health and readiness probes and the inspection API on the configured address
+// until the context is cancelled.
+func (app *App) runHTTPServer(ctx context.Context, wg *sync.WaitGroup) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/healthz", app.handleHealthz)
+	mux.HandleFunc("/readyz", app.handleReadyz)
+	mux.HandleFunc("/api/services", app.handleInspectServices)
+	mux.HandleFunc("/api/records", app.handleInspectRecords)
+	mux.HandleFunc("/api/plan", app.handleInspectPlan)
+	mux.HandleFunc("/api/errors", app.handleInspectErrors)
+	mux.HandleFunc("/api/ownership", app.handleInspectOwnership)
+
+	srv := &http.Server{
+		Addr:              app.opts.httpAddress,
+		Handler:           mux,
+		ReadHeaderTimeout: time.Second * 10,
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+
+		app.lo.Info("Starting HTTP server", "address", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			app.lo.Error("HTTP server failed", "address", srv.Addr, "error", err)
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+
+		<-ctx.Done()
+		app.lo.Warn("Context cancellation received, terminating worker", "worker", "http")
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			app.lo.Error("Error shutting down HTTP server", "error", err)
+		}
+	}()
+}
+
+// handleMetrics serves the metrics in the Prometheus exposition format, along with the Go runtime and process metrics.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics.WritePrometheus(w, true)
+}
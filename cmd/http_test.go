@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleMetrics(t *testing.T) {
+	setManagedRecords("rfc2136", "test.internal.", 3)
+	observeProviderCall("rfc2136", "set", "test.internal.", time.Now(), nil)
+
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `nomad_external_dns_managed_records{provider="rfc2136",zone="test.internal."} 3`)
+	assert.Contains(t, rec.Body.String(), `nomad_external_dns_provider_request_duration_seconds_count{provider="rfc2136",operation="set",zone="test.internal."} 1`)
+}
@@ -28,15 +28,19 @@ func initLogger(ko *koanf.Koanf) *slog.Logger {
 	return logger
 }
 
-// initConfig loads config to `ko` object.
-func initConfig(cfgDefault string, envPrefix string) *koanf.Koanf {
+// initConfig loads config to `ko` object. It returns the command line arguments after the flags,
+// which are the command to run along with its own flags.
+func initConfig(cfgDefault string, envPrefix string) (*koanf.Koanf, []string) {
 	var (
 		ko = koanf.New(".")
 		f  = flag.NewFlagSet("front", flag.ContinueOnError)
 	)
 
-	// Configure Flags.
+	// Configure Flags. Parsing stops at the command, so that the flags after it are parsed by the command.
+	f.SetInterspersed(false)
 	f.Usage = func() {
+		fmt.Println("Usage: nomad-external-dns [--config config.toml] [command]")
+		fmt.Print(commandUsage)
 		fmt.Println(f.FlagUsages())
 		os.Exit(0)
 	}
@@ -47,25 +51,25 @@ func initConfig(cfgDefault string, envPrefix string) *koanf.Koanf {
 	// Parse and Load Flags.
 	err := f.Parse(os.Args[1:])
 	if err != nil {
-		fmt.Printf("error parsing flags: %v\n", err)
+		fmt.Fprintf(os.Stderr, "error parsing flags: %v\n", err)
 		os.Exit(1)
 	}
 
 	// Load the config files from the path provided.
-	fmt.Printf("attempting to load config from file: %s\n", *cfgPath)
+	fmt.Fprintf(os.Stderr, "attempting to load config from file: %s\n", *cfgPath)
 
 	err = ko.Load(file.Provider(*cfgPath), toml.Parser())
 	if err != nil {
 		// If the default config is not present, print a warning and continue reading the values from env.
 		if *cfgPath == cfgDefault {
-			fmt.Printf("unable to open sample config file: %v\n", err)
+			fmt.Fprintf(os.Stderr, "unable to open sample config file: %v\n", err)
 		} else {
-			fmt.Printf("error loading config: %v\n", err)
+			fmt.Fprintf(os.Stderr, "error loading config: %v\n", err)
 			os.Exit(1)
 		}
 	}
 
-	fmt.Printf("attempting to read config from env vars\n")
+	fmt.Fprintf(os.Stderr, "attempting to read config from env vars\n")
 	// Load environment variables if the key is given
 	// and merge into the loaded config.
 	if envPrefix != "" {
@@ -74,53 +78,204 @@ func initConfig(cfgDefault string, envPrefix string) *koanf.Koanf {
 				strings.TrimPrefix(s, envPrefix)), "__", ".", -1)
 		}), nil)
 		if err != nil {
-			fmt.Printf("error loading env config: %v\n", err)
+			fmt.Fprintf(os.Stderr, "error loading env config: %v\n", err)
 			os.Exit(1)
 		}
 	}
 
-	return ko
+	return ko, f.Args()
 }
 
-// initNomadClient initialises a Nomad API client.
-func initNomadClient() (*api.Client, error) {
-	client, err := api.NewClient(api.DefaultConfig())
-	if err != nil {
-		return nil, err
+// defaultSourceName is the name of the Nomad source when no `nomad.sources` are configured.
+const defaultSourceName = "default"
+
+// initNomadSources initialises an API client for every configured Nomad source.
+// Without a list of `[[nomad.sources]]`, a single source is configured from the Nomad environment variables.
+func initNomadSources(ko *koanf.Koanf) ([]*nomadSource, error) {
+	if !ko.Exists("nomad.sources") {
+		cfg := api.DefaultConfig()
+		client, err := api.NewClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return []*nomadSource{newNomadSource(defaultSourceName, cfg.Region, client)}, nil
+	}
+
+	sources := make([]*nomadSource, 0)
+	for i, sko := range ko.Slices("nomad.sources") {
+		name := sko.String("name")
+		if name == "" {
+			name = fmt.Sprintf("source-%d", i)
+		}
+		for _, src := range sources {
+			if src.name == name {
+				return nil, fmt.Errorf("duplicate nomad source: %s", name)
+			}
+		}
+
+		// Unset values fall back to the Nomad environment variables.
+		cfg := api.DefaultConfig()
+		if v := sko.String("address"); v != "" {
+			cfg.Address = v
+		}
+		if v := sko.String("region"); v != "" {
+			cfg.Region = v
+		}
+		if v := sko.String("token"); v != "" {
+			cfg.SecretID = v
+		}
+		if v := sko.String("ca_cert"); v != "" {
+			cfg.TLSConfig.CACert = v
+		}
+		if v := sko.String("client_cert"); v != "" {
+			cfg.TLSConfig.ClientCert = v
+		}
+		if v := sko.String("client_key"); v != "" {
+			cfg.TLSConfig.ClientKey = v
+		}
+		if v := sko.String("tls_server_name"); v != "" {
+			cfg.TLSConfig.TLSServerName = v
+		}
+		if sko.Bool("tls_skip_verify") {
+			cfg.TLSConfig.Insecure = true
+		}
+
+		client, err := api.NewClient(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("error initializing nomad source %s: %w", name, err)
+		}
+		sources = append(sources, newNomadSource(name, cfg.Region, client))
 	}
-	return client, nil
+
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no nomad sources configured")
+	}
+	return sources, nil
 }
 
 func initOpts(ko *koanf.Koanf) Opts {
+	maxConcurrentFetches := ko.Int("nomad.max_concurrent_fetches")
+	if maxConcurrentFetches <= 0 {
+		maxConcurrentFetches = defaultMaxConcurrentFetches
+	}
+
 	return Opts{
-		updateInterval: ko.MustDuration("app.update_interval"),
-		pruneInterval:  ko.MustDuration("app.prune_interval"),
-		domains:        ko.MustStrings("dns.domain_filters"),
-		dryRun:         ko.Bool("app.dry_run"),
-		owner:          ko.MustString("dns.owner_uuid"),
+		updateInterval:       ko.MustDuration("app.update_interval"),
+		pruneInterval:        ko.MustDuration("app.prune_interval"),
+		dryRun:               ko.Bool("app.dry_run"),
+		watchEvents:          ko.Bool("app.watch_events"),
+		owner:                ko.MustString("dns.owner_uuid"),
+		maxConcurrentFetches: maxConcurrentFetches,
+		healthyOnly:          ko.Bool("nomad.healthy_only"),
+		healthyFailOpen:      ko.Bool("nomad.healthy_only_fail_open"),
+		metaAnnotations:      ko.Bool("nomad.meta_annotations"),
+		httpAddress:          ko.String("app.http_address"),
+	}
+}
+
+// initProviders initialises all the configured DNS providers along with the zones they own.
+// A list of `[[providers]]` takes precedence over the single provider configured with `dns.provider`.
+func initProviders(ko *koanf.Koanf) ([]providerInstance, error) {
+	if !ko.Exists("providers") {
+		kind := ko.MustString("dns.provider")
+		prov, err := initProvider(kind, ko.Cut("provider"))
+		if err != nil {
+			return nil, err
+		}
+		return []providerInstance{{
+			name:     kind,
+			provider: prov,
+			domains:  ko.MustStrings("dns.domain_filters"),
+		}}, nil
+	}
+
+	var (
+		providers = make([]providerInstance, 0)
+		owners    = make(map[string]string) // Zone to the name of the provider which owns it.
+	)
+	for i, pko := range ko.Slices("providers") {
+		kind := pko.MustString("type")
+		name := pko.String("name")
+		if name == "" {
+			name = fmt.Sprintf("%s-%d", kind, i)
+		}
+
+		// A zone can be owned by only one provider, otherwise records can't be routed.
+		domains := pko.MustStrings("domain_filters")
+		for _, d := range domains {
+			if owner, ok := owners[EnsureFQDN(d)]; ok {
+				return nil, fmt.Errorf("domain %s is configured for both %s and %s providers", d, owner, name)
+			}
+			owners[EnsureFQDN(d)] = name
+		}
+
+		prov, err := initProvider(kind, pko)
+		if err != nil {
+			return nil, fmt.Errorf("error initializing provider %s: %w", name, err)
+		}
+		providers = append(providers, providerInstance{name: name, provider: prov, domains: domains})
 	}
+
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("no providers configured")
+	}
+	return providers, nil
 }
 
 // initProvider initialises a DNS controller object to interact with
-// the upstream DNS provider.
-func initProvider(ko *koanf.Koanf) (DNSProvider, error) {
+// the upstream DNS provider. The keys in `ko` are relative to the provider's config.
+func initProvider(kind string, ko *koanf.Koanf) (DNSProvider, error) {
 	var (
 		provider DNSProvider
 		err      error
 	)
 
-	switch ko.MustString("dns.provider") {
+	switch kind {
 	case "route53":
 		provider, err = route53.NewProvider(context.Background(), route53.Opt{
-			MaxRetries: ko.Int("provider.route53.max_retries"),
-			Region:     ko.MustString("provider.route53.region"), // libdns defaults to us-east-1 so this **must** be provided.
+			MaxRetries: ko.Int("route53.max_retries"),
+			Region:     ko.MustString("route53.region"), // libdns defaults to us-east-1 so this **must** be provided.
+		})
+		if err != nil {
+			return nil, err
+		}
+
+	case "cloudflare":
+		provider, err = NewCloudflareProvider(cloudflareOpts{
+			APIToken: ko.MustString("cloudflare.api_token"),
+			BaseURL:  ko.String("cloudflare.api_url"),
+			Proxied:  ko.Bool("cloudflare.proxied"),
+			Timeout:  ko.Duration("cloudflare.timeout"),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+	case "rfc2136":
+		provider, err = NewRFC2136Provider(rfc2136Opts{
+			Nameserver:    ko.MustString("rfc2136.nameserver"),
+			TSIGKeyName:   ko.String("rfc2136.tsig_key_name"),
+			TSIGSecret:    ko.String("rfc2136.tsig_secret"),
+			TSIGAlgorithm: ko.String("rfc2136.tsig_algorithm"),
+			Timeout:       ko.Duration("rfc2136.timeout"),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+	case "powerdns":
+		provider, err = NewPowerDNSProvider(powerDNSOpts{
+			BaseURL:  ko.MustString("powerdns.api_url"),
+			APIKey:   ko.MustString("powerdns.api_key"),
+			ServerID: ko.String("powerdns.server_id"),
+			Timeout:  ko.Duration("powerdns.timeout"),
 		})
 		if err != nil {
 			return nil, err
 		}
 
 	default:
-		return nil, fmt.Errorf("unknown provider type")
+		return nil, fmt.Errorf("unknown provider type: %s", kind)
 	}
 
 	// Initialise the controller object.
@@ -136,23 +291,84 @@ func initApp(ko *koanf.Koanf) (*App, error) {
 		return nil, fmt.Errorf("prune_interval should be greater than update_interval")
 	}
 
-	prov, err := initProvider(ko)
+	filters, err := initSourceFilters(ko)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to initialize Nomad filters: %w", err)
+	}
+	opts.filters = filters
+
+	opts.hostnameTemplate, err = initHostnameTemplate(ko.String("dns.hostname_template"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse hostname template: %w", err)
+	}
+	opts.templateNamespaces = ko.Strings("dns.hostname_template_namespaces")
+
+	opts.annotationPrefix, err = parseAnnotationPrefix(ko.String("dns.annotation_prefix"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse annotation prefix: %w", err)
+	}
+
+	// Nomad and the DNS providers have to be reached within the staleness window for the app to be ready.
+	// Without changes, DNS providers are only called when pruning, so it defaults to a few prune intervals.
+	staleness := ko.Duration("app.readiness_staleness")
+	if staleness <= 0 {
+		staleness = 3 * opts.pruneInterval
+	}
+
+	opts.policy, err = parsePolicy(ko.String("dns.policy"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse policy: %w", err)
+	}
+
+	providers, err := initProviders(ko)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to initialize DNS provider: %w", err)
 	}
 
-	client, err := initNomadClient()
+	// Domain filters of all the providers are used to determine the zone of a hostname.
+	for _, p := range providers {
+		opts.domains = append(opts.domains, p.domains...)
+		logger.Info("Initialized DNS provider", "provider", p.name, "domains", p.domains)
+	}
+
+	sources, err := initNomadSources(ko)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to initialize Nomad API client: %w", err)
 	}
 
-	logger.Info("Initialized Nomad client", "addr", client.Address())
+	for _, src := range sources {
+		logger.Info("Initialized Nomad client", "source", src.name, "region", src.region, "addr", src.client.Address())
+	}
+
+	app := &App{
+		lo:        logger,
+		opts:      opts,
+		services:  make(map[string]ServiceMeta, 0),
+		providers: providers,
+		sources:   sources,
+		probes:    probeState{staleness: staleness},
+		guard: deletionGuard{
+			maxPercent:  ko.Float64("app.prune_max_delete_percent"),
+			minOwned:    defaultPruneMinOwned,
+			maxCount:    ko.Int("app.prune_max_deletes"),
+			graceCycles: ko.Int("app.prune_grace_cycles"),
+			gracePeriod: ko.Duration("app.prune_grace_period"),
+		},
+	}
+	if ko.Exists("app.prune_min_owned") {
+		app.guard.minOwned = ko.Int("app.prune_min_owned")
+	}
+
+	// With leader election, several instances can run at once and only the leader syncs the records.
+	if ko.Bool("leader_election.enabled") {
+		lock, err := initLeaderLock(sources[0], ko.String("leader_election.path"), ko.String("leader_election.namespace"),
+			ko.Duration("leader_election.ttl"), ko.Duration("leader_election.lock_delay"))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to initialize leader election: %w", err)
+		}
+		app.leaderLock = lock
+		logger.Info("Initialized leader election", "source", sources[0].name, "path", lock.path, "ttl", lock.lockTTL)
+	}
 
-	return &App{
-		lo:          logger,
-		opts:        opts,
-		services:    make(map[string]ServiceMeta, 0),
-		provider:    prov,
-		nomadClient: client,
-	}, nil
+	return app, nil
 }
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// inspectState keeps the results of the last sync and prune, which are exposed by the inspection API.
+type inspectState struct {
+	mu sync.RWMutex
+
+	// records are the owned records fetched in the last prune of every provider, grouped by name.
+	records map[string]map[string][]RecordMeta
+	// prunePlans are the plans computed in the last prune of every provider.
+	prunePlans map[string]timedPlan
+	// syncPlan is the last plan with changes computed when syncing services.
+	syncPlan timedPlan
+	// errors are the errors of the services whose records couldn't be computed in the last sync, by DNS name.
+	errors map[string]serviceError
+}
+
+// timedPlan is a plan along with the time it was computed at.
+type timedPlan struct {
+	plan Plan
+	at   time.Time
+}
+
+// serviceError is an error encountered when computing the records of a service.
+type serviceError struct {
+	service ServiceMeta
+	err     error
+	at      time.Time
+}
+
+// setRecords stores the owned records fetched from a provider.
+func (s *inspectState) setRecords(provider string, records map[string][]RecordMeta) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.records == nil {
+		s.records = make(map[string]map[string][]RecordMeta)
+	}
+	s.records[provider] = records
+}
+
+// setPrunePlan stores the plan computed in a prune of a provider.
+func (s *inspectState) setPrunePlan(provider string, plan Plan, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.prunePlans == nil {
+		s.prunePlans = make(map[string]timedPlan)
+	}
+	s.prunePlans[provider] = timedPlan{plan: plan, at: now}
+}
+
+// setSyncPlan stores the plan computed in a sync, if it has any changes.
+func (s *inspectState) setSyncPlan(plan Plan, now time.Time) {
+	if plan.isEmpty() {
+		return
+	}
+
+	s.mu.Lock()
+	s.syncPlan = timedPlan{plan: plan, at: now}
+	s.mu.Unlock()
+}
+
+// setError stores the error encountered when computing the records of a service, or clears it if nil.
+func (s *inspectState) setError(key string, svc ServiceMeta, err error, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err == nil {
+		delete(s.errors, key)
+		return
+	}
+	if s.errors == nil {
+		s.errors = make(map[string]serviceError)
+	}
+	s.errors[key] = serviceError{service: svc, err: err, at: now}
+}
+
+// retainErrors forgets the errors of the services which are gone.
+func (s *inspectState) retainErrors(services map[string]ServiceMeta) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.errors {
+		if _, ok := services[key]; !ok {
+			delete(s.errors, key)
+		}
+	}
+}
+
+// serviceView is the JSON representation of a service.
+type serviceView struct {
+	Name        string              `json:"name"`
+	Namespace   string              `json:"namespace"`
+	Job         string              `json:"job"`
+	Datacenter  string              `json:"datacenter"`
+	Cluster     string              `json:"cluster"`
+	Region      string              `json:"region"`
+	DNSName     string              `json:"dns_name"`
+	Addresses   []string            `json:"addresses"`
+	Tags        []string            `json:"tags"`
+	Annotations map[string][]string `json:"annotations"`
+	Endpoints   []endpointView      `json:"endpoints"`
+}
+
+// endpointView is the JSON representation of an endpoint of a service.
+type endpointView struct {
+	AllocID string `json:"alloc_id"`
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+}
+
+// recordView is the JSON representation of a record set.
+type recordView struct {
+	Zone  string `json:"zone"`
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	TTL   string `json:"ttl"`
+}
+
+// changeView is the JSON representation of a change of a plan.
+type changeView struct {
+	recordView
+	Previous string `json:"previous,omitempty"`
+}
+
+// planView is the JSON representation of a plan.
+type planView struct {
+	ComputedAt time.Time    `json:"computed_at"`
+	Creates    []changeView `json:"creates"`
+	Updates    []changeView `json:"updates"`
+	Deletes    []changeView `json:"deletes"`
+}
+
+// serviceErrorView is the JSON representation of the error of a service.
+type serviceErrorView struct {
+	DNSName   string    `json:"dns_name"`
+	Service   string    `json:"service"`
+	Namespace string    `json:"namespace"`
+	Cluster   string    `json:"cluster"`
+	Error     string    `json:"error"`
+	At        time.Time `json:"at"`
+}
+
+// ownershipView is the JSON representation of an ownership TXT record.
+type ownershipView struct {
+	Zone   string            `json:"zone"`
+	Name   string            `json:"name"`
+	Fields map[string]string `json:"fields"`
+}
+
+func newServiceView(s ServiceMeta) serviceView {
+	endpoints := make([]endpointView, 0, len(s.Endpoints))
+	for _, e := range s.Endpoints {
+		endpoints = append(endpoints, endpointView{AllocID: e.AllocID, Address: e.Address, Port: e.Port})
+	}
+	return serviceView{
+		Name:        s.Name,
+		Namespace:   s.Namespace,
+		Job:         s.Job,
+		Datacenter:  s.Datacenter,
+		Cluster:     s.Cluster,
+		Region:      s.Region,
+		DNSName:     s.DNSName,
+		Addresses:   s.Addresses,
+		Tags:        s.Tags,
+		Annotations: s.Annotations,
+		Endpoints:   endpoints,
+	}
+}
+
+func newChangeViews(changes []Change) []changeView {
+	views := make([]changeView, 0, len(changes))
+	for _, c := range changes {
+		v := changeView{recordView: recordView{Zone: c.Zone, Name: c.Record.Name, Type: c.Record.Type, Value: c.Record.Value, TTL: c.Record.TTL.String()}}
+		if c.Previous.Type != "" {
+			v.Previous = c.Previous.Value
+		}
+		views = append(views, v)
+	}
+	return views
+}
+
+func newPlanView(p timedPlan) planView {
+	return planView{
+		ComputedAt: p.at,
+		Creates:    newChangeViews(p.plan.Creates),
+		Updates:    newChangeViews(p.plan.Updates),
+		Deletes:    newChangeViews(p.plan.Deletes),
+	}
+}
+
+// handleInspectServices serves the services whose records are synced, by DNS name.
+func (app *App) handleInspectServices(w http.ResponseWriter, r *http.Request) {
+	app.RLock()
+	services := make(map[string]serviceView, len(app.services))
+	for key, s := range app.services {
+		services[key] = newServiceView(s)
+	}
+	app.RUnlock()
+
+	writeJSON(w, r, services)
+}
+
+// handleInspectRecords serves the owned records fetched in the last prune, by provider.
+func (app *App) handleInspectRecords(w http.ResponseWriter, r *http.Request) {
+	app.inspect.mu.RLock()
+	records := make(map[string][]recordView, len(app.inspect.records))
+	for provider, byName := range app.inspect.records {
+		views := make([]recordView, 0, len(byName))
+		for _, metas := range byName {
+			for _, m := range metas {
+				for _, rec := range m.Records {
+					views = append(views, recordView{Zone: m.Zone, Name: rec.Name, Type: rec.Type, Value: rec.Value, TTL: rec.TTL.String()})
+				}
+			}
+		}
+		sortRecordViews(views)
+		records[provider] = views
+	}
+	app.inspect.mu.RUnlock()
+
+	writeJSON(w, r, records)
+}
+
+// handleInspectPlan serves the last plan with changes of the sync, and the last plan of the prune of every provider.
+func (app *App) handleInspectPlan(w http.ResponseWriter, r *http.Request) {
+	app.inspect.mu.RLock()
+	resp := struct {
+		Sync  *planView           `json:"sync"`
+		Prune map[string]planView `json:"prune"`
+	}{Prune: make(map[string]planView, len(app.inspect.prunePlans))}
+	if !app.inspect.syncPlan.at.IsZero() {
+		v := newPlanView(app.inspect.syncPlan)
+		resp.Sync = &v
+	}
+	for provider, p := range app.inspect.prunePlans {
+		resp.Prune[provider] = newPlanView(p)
+	}
+	app.inspect.mu.RUnlock()
+
+	writeJSON(w, r, resp)
+}
+
+// handleInspectErrors serves the errors of the services whose records couldn't be computed, sorted by DNS name.
+func (app *App) handleInspectErrors(w http.ResponseWriter, r *http.Request) {
+	app.inspect.mu.RLock()
+	errs := make([]serviceErrorView, 0, len(app.inspect.errors))
+	for _, e := range app.inspect.errors {
+		errs = append(errs, serviceErrorView{
+			DNSName:   e.service.DNSName,
+			Service:   e.service.Name,
+			Namespace: e.service.Namespace,
+			Cluster:   e.service.Cluster,
+			Error:     e.err.Error(),
+			At:        e.at,
+		})
+	}
+	app.inspect.mu.RUnlock()
+
+	sort.Slice(errs, func(i, j int) bool { return errs[i].DNSName < errs[j].DNSName })
+	writeJSON(w, r, errs)
+}
+
+// handleInspectOwnership serves the fields of the ownership TXT records fetched in the last prune, by provider.
+func (app *App) handleInspectOwnership(w http.ResponseWriter, r *http.Request) {
+	app.inspect.mu.RLock()
+	ownership := make(map[string][]ownershipView, len(app.inspect.records))
+	for provider, byName := range app.inspect.records {
+		views := make([]ownershipView, 0)
+		for _, metas := range byName {
+			for _, m := range metas {
+				for _, rec := range m.Records {
+					if rec.Type == "TXT" {
+						views = append(views, ownershipView{Zone: m.Zone, Name: rec.Name, Fields: parseOwnershipRecord(rec.Value)})
+					}
+				}
+			}
+		}
+		sort.Slice(views, func(i, j int) bool { return views[i].Zone+views[i].Name < views[j].Zone+views[j].Name })
+		ownership[provider] = views
+	}
+	app.inspect.mu.RUnlock()
+
+	writeJSON(w, r, ownership)
+}
+
+// sortRecordViews sorts record sets by zone, name and type.
+func sortRecordViews(views []recordView) {
+	sort.Slice(views, func(i, j int) bool {
+		a, b := views[i], views[j]
+		if a.Zone != b.Zone {
+			return a.Zone < b.Zone
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Type < b.Type
+	})
+}
+
+// writeJSON writes the response of a read-only endpoint as indented JSON.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
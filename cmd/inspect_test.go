@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInspectAPI(t *testing.T) {
+	now := time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)
+	app := &App{services: map[string]ServiceMeta{
+		"redis.test.internal.": {Name: "redis", Namespace: "default", Cluster: "default", DNSName: "redis.test.internal", Addresses: []string{"10.0.0.1"}},
+	}}
+
+	app.inspect.setRecords("rfc2136", map[string][]RecordMeta{
+		"redis.test.internal.": {
+			{Zone: "test.internal.", Records: []libdns.Record{{Type: "TXT", Name: "redis.", Value: `"service=redis namespace=default owner=test-owner created-by=nomad-external-dns"`, TTL: 30 * time.Second}}},
+			{Zone: "test.internal.", Records: []libdns.Record{{Type: "A", Name: "redis.", Value: "10.0.0.2", TTL: 30 * time.Second}}},
+		},
+	})
+	app.inspect.setPrunePlan("rfc2136", Plan{Updates: []Change{{
+		Zone:     "test.internal.",
+		Record:   libdns.Record{Type: "A", Name: "redis", Value: "10.0.0.1", TTL: 30 * time.Second},
+		Previous: libdns.Record{Type: "A", Name: "redis.", Value: "10.0.0.2", TTL: 30 * time.Second},
+	}}}, now)
+	app.inspect.setSyncPlan(Plan{}, now)
+
+	web := ServiceMeta{Name: "web", Namespace: "default", DNSName: "web.example.org"}
+	app.inspect.setError("web.example.org.", web, errors.New("hostname doesn't contain a valid domain TLD"), now)
+	app.inspect.setError("api.test.internal.", ServiceMeta{Name: "api"}, errors.New("no valid addresses"), now)
+	app.inspect.setError("api.test.internal.", ServiceMeta{Name: "api"}, nil, now)
+
+	get := func(handler http.HandlerFunc, v interface{}) {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), v))
+	}
+
+	var services map[string]serviceView
+	get(app.handleInspectServices, &services)
+	assert.Equal(t, []string{"10.0.0.1"}, services["redis.test.internal."].Addresses)
+
+	var records map[string][]recordView
+	get(app.handleInspectRecords, &records)
+	assert.Equal(t, []recordView{
+		{Zone: "test.internal.", Name: "redis.", Type: "A", Value: "10.0.0.2", TTL: "30s"},
+		{Zone: "test.internal.", Name: "redis.", Type: "TXT", Value: `"service=redis namespace=default owner=test-owner created-by=nomad-external-dns"`, TTL: "30s"},
+	}, records["rfc2136"])
+
+	var plan struct {
+		Sync  *planView           `json:"sync"`
+		Prune map[string]planView `json:"prune"`
+	}
+	get(app.handleInspectPlan, &plan)
+	assert.Nil(t, plan.Sync, "empty plans aren't kept")
+	assert.Len(t, plan.Prune["rfc2136"].Updates, 1)
+	assert.Equal(t, "10.0.0.2", plan.Prune["rfc2136"].Updates[0].Previous)
+
+	var errs []serviceErrorView
+	get(app.handleInspectErrors, &errs)
+	assert.Equal(t, []serviceErrorView{{
+		DNSName:   "web.example.org",
+		Service:   "web",
+		Namespace: "default",
+		Error:     "hostname doesn't contain a valid domain TLD",
+		At:        now,
+	}}, errs)
+
+	var ownership map[string][]ownershipView
+	get(app.handleInspectOwnership, &ownership)
+	assert.Equal(t, []ownershipView{{
+		Zone:   "test.internal.",
+		Name:   "redis.",
+		Fields: map[string]string{"service": "redis", "namespace": "default", "owner": "test-owner", "created-by": "nomad-external-dns"},
+	}}, ownership["rfc2136"])
+
+	app.inspect.retainErrors(app.services)
+	get(app.handleInspectErrors, &errs)
+	assert.Empty(t, errs)
+
+	rec := httptest.NewRecorder()
+	app.handleInspectServices(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// errLockLost is returned when the lock is held by another instance, or has expired.
+var errLockLost = errors.New("lock is held by another instance")
+
+// leaderLock is a lock which is held by a single instance at a time.
+type leaderLock interface {
+	// acquire tries to acquire the lock and returns false if it's held by another instance.
+	acquire(ctx context.Context) (bool, error)
+	// renew extends the lease on the lock. It returns errLockLost if the lock is no longer held.
+	renew(ctx context.Context) error
+	// release gives up the lock, so that another instance can acquire it right away.
+	release(ctx context.Context) error
+	// ttl is the duration the lock is held for without being renewed.
+	ttl() time.Duration
+}
+
+// nomadLock is a leaderLock on a Nomad variable.
+type nomadLock struct {
+	client    *api.Client
+	path      string
+	namespace string
+	lockTTL   time.Duration
+	lockDelay time.Duration
+
+	// id is the ID of the lock while it's held, generated by Nomad.
+	id string
+}
+
+// variable returns the variable of the lock, along with the given lock settings.
+func (l *nomadLock) variable(lock *api.VariableLock) *api.Variable {
+	return &api.Variable{Path: l.path, Namespace: l.namespace, Lock: lock}
+}
+
+func (l *nomadLock) writeOptions(ctx context.Context) *api.WriteOptions {
+	return (&api.WriteOptions{Namespace: l.namespace}).WithContext(ctx)
+}
+
+func (l *nomadLock) acquire(ctx context.Context) (bool, error) {
+	v, _, err := l.client.Variables().AcquireLock(l.variable(&api.VariableLock{
+		TTL:       l.lockTTL.String(),
+		LockDelay: l.lockDelay.String(),
+	}), l.writeOptions(ctx))
+	if err != nil {
+		if isConflict(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	l.id = v.LockID()
+	return true, nil
+}
+
+func (l *nomadLock) renew(ctx context.Context) error {
+	_, _, err := l.client.Variables().RenewLock(l.variable(&api.VariableLock{ID: l.id}), l.writeOptions(ctx))
+	if isConflict(err) {
+		return errLockLost
+	}
+	return err
+}
+
+func (l *nomadLock) release(ctx context.Context) error {
+	_, _, err := l.client.Variables().ReleaseLock(l.variable(&api.VariableLock{ID: l.id}), l.writeOptions(ctx))
+	if isConflict(err) {
+		return errLockLost
+	}
+	return err
+}
+
+func (l *nomadLock) ttl() time.Duration {
+	return l.lockTTL
+}
+
+// isConflict checks if a lock operation failed because the lock is held by another instance.
+func isConflict(err error) bool {
+	var respErr api.UnexpectedResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode() == http.StatusConflict
+}
+
+// campaign keeps trying to acquire the lock until the context is cancelled. While the lock is held,
+// the workers are run with `run`, and they're stopped as soon as the lock is lost.
+// The lock is retried at every half of its TTL, so a follower takes over within the TTL and lock delay
+// once the leader is gone.
+func (app *App) campaign(ctx context.Context, lock leaderLock, run func(ctx context.Context, wg *sync.WaitGroup)) {
+	app.probes.setStandby(true)
+
+	for {
+		acquired, err := lock.acquire(ctx)
+		switch {
+		case err != nil:
+			if ctx.Err() == nil {
+				app.lo.Error("Error acquiring leader lock", "error", err)
+			}
+		case acquired:
+			app.probes.nomadFetched(time.Now())
+			app.lead(ctx, lock, run)
+		default:
+			app.probes.nomadFetched(time.Now())
+			app.lo.Debug("Leader lock is held by another instance")
+		}
+
+		select {
+		case <-time.After(lock.ttl() / 2):
+		case <-ctx.Done():
+			app.lo.Warn("Context cancellation received, terminating worker", "worker", "election")
+			return
+		}
+	}
+}
+
+// lead runs the workers and keeps the lock until it's lost or the context is cancelled.
+// The workers are stopped before returning, and the lock is released on cancellation.
+func (app *App) lead(ctx context.Context, lock leaderLock, run func(ctx context.Context, wg *sync.WaitGroup)) {
+	app.lo.Info("Acquired leadership, starting workers")
+	setLeader(true)
+	app.probes.setStandby(false)
+
+	var (
+		wg                sync.WaitGroup
+		leaderCtx, cancel = context.WithCancel(ctx)
+	)
+	run(leaderCtx, &wg)
+
+	app.holdLock(ctx, lock)
+
+	cancel()
+	wg.Wait()
+	setLeader(false)
+	app.probes.setStandby(true)
+
+	if ctx.Err() == nil {
+		app.lo.Warn("Lost leadership, stopped workers")
+		return
+	}
+
+	// Release the lock so that a follower doesn't have to wait for it to expire.
+	releaseCtx, cancelRelease := context.WithTimeout(context.Background(), lock.ttl())
+	defer cancelRelease()
+	if err := lock.release(releaseCtx); err != nil {
+		app.lo.Error("Error releasing leader lock", "error", err)
+		return
+	}
+	app.lo.Info("Released leadership")
+}
+
+// holdLock renews the lock at every quarter of its TTL, and returns once the lock is lost or the context is cancelled.
+// The lock is considered lost if it can't be renewed within half of its TTL, and a renew which hangs is cancelled
+// by then. This leaves the other half of the TTL to stop the workers before another instance can acquire the lock.
+func (app *App) holdLock(ctx context.Context, lock leaderLock) {
+	ticker := time.NewTicker(lock.ttl() / 4)
+	defer ticker.Stop()
+
+	deadline := time.Now().Add(lock.ttl() / 2)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// The lease is extended from the time the lock is renewed, which is after the request is sent.
+			start := time.Now()
+			renewCtx, cancelRenew := context.WithDeadline(ctx, deadline)
+			err := lock.renew(renewCtx)
+			cancelRenew()
+			if err == nil {
+				deadline = start.Add(lock.ttl() / 2)
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+
+			app.lo.Error("Error renewing leader lock", "error", err)
+			if errors.Is(err, errLockLost) || !time.Now().Before(deadline) {
+				return
+			}
+		}
+	}
+}
+
+// runLockedWith runs a one-shot command while holding the lock, so that it doesn't change the records along with
+// the leader. It fails right away if the lock is held by another instance. The lock is kept with holdLock,
+// and the context of the command is cancelled once the lock is lost. The lock is released on return.
+func (app *App) runLockedWith(ctx context.Context, lock leaderLock, run func(ctx context.Context) error) error {
+	acquired, err := lock.acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("error acquiring leader lock: %w", err)
+	}
+	if !acquired {
+		return fmt.Errorf("refusing to change the records while the leader runs: %w", errLockLost)
+	}
+
+	var (
+		wg             sync.WaitGroup
+		runCtx, cancel = context.WithCancel(ctx)
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		app.holdLock(runCtx, lock)
+		cancel()
+	}()
+
+	err = run(runCtx)
+	if runCtx.Err() != nil && ctx.Err() == nil {
+		err = fmt.Errorf("leader lock was lost: %w", errLockLost)
+	}
+	cancel()
+	wg.Wait()
+
+	releaseCtx, cancelRelease := context.WithTimeout(context.Background(), lock.ttl())
+	defer cancelRelease()
+	if relErr := lock.release(releaseCtx); relErr != nil && !errors.Is(relErr, errLockLost) {
+		app.lo.Error("Error releasing leader lock", "error", relErr)
+	}
+	return err
+}
+
+// initLeaderLock initialises the lock for leader election on a Nomad variable of the first Nomad source.
+func initLeaderLock(src *nomadSource, path, namespace string, ttl, delay time.Duration) (*nomadLock, error) {
+	if path == "" {
+		return nil, fmt.Errorf("path of the lock variable can't be empty")
+	}
+	if ttl <= 0 {
+		ttl = api.DefaultLockTTL
+	}
+	if delay <= 0 {
+		delay = api.DefaultLockDelay
+	}
+	return &nomadLock{client: src.client, path: path, namespace: namespace, lockTTL: ttl, lockDelay: delay}, nil
+}
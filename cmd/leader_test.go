@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
+)
+
+// fakeLock is a leaderLock which is acquired once, and lost after a number of renewals.
+// With hang, the renewals block until they're cancelled, like a request to an unreachable server.
+type fakeLock struct {
+	mu        sync.Mutex
+	acquired  bool
+	attempts  int
+	renewals  int
+	maxRenew  int
+	hang      bool
+	lockTTL   time.Duration
+	released  bool
+	acquireCh chan struct{}
+}
+
+func (l *fakeLock) acquire(context.Context) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.attempts++
+	if l.acquired {
+		return false, nil
+	}
+	l.acquired = true
+	close(l.acquireCh)
+	return true, nil
+}
+
+func (l *fakeLock) renew(ctx context.Context) error {
+	if l.hang {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.renewals++
+	if l.maxRenew > 0 && l.renewals > l.maxRenew {
+		return errLockLost
+	}
+	return nil
+}
+
+func (l *fakeLock) release(context.Context) error {
+	l.mu.Lock()
+	l.released = true
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *fakeLock) ttl() time.Duration {
+	if l.lockTTL > 0 {
+		return l.lockTTL
+	}
+	return 20 * time.Millisecond
+}
+
+func (l *fakeLock) state() (attempts int, released bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.attempts, l.released
+}
+
+func TestCampaign(t *testing.T) {
+	newApp := func() *App {
+		return &App{lo: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	}
+
+	// workers counts the running workers, which run until their context is cancelled.
+	run := func(running *int32) func(ctx context.Context, wg *sync.WaitGroup) {
+		return func(ctx context.Context, wg *sync.WaitGroup) {
+			wg.Add(1)
+			atomic.AddInt32(running, 1)
+			go func() {
+				defer wg.Done()
+				<-ctx.Done()
+				atomic.AddInt32(running, -1)
+			}()
+		}
+	}
+
+	t.Run("lost leadership stops the workers", func(t *testing.T) {
+		var (
+			app     = newApp()
+			lock    = &fakeLock{maxRenew: 2, acquireCh: make(chan struct{})}
+			running int32
+		)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			app.campaign(ctx, lock, run(&running))
+			close(done)
+		}()
+
+		<-lock.acquireCh
+		assert.Eventually(t, func() bool { return atomic.LoadInt32(&running) == 1 }, time.Second, time.Millisecond)
+		// The lock is tried again once the leadership is lost.
+		assert.Eventually(t, func() bool { attempts, _ := lock.state(); return attempts > 1 }, time.Second, time.Millisecond)
+		assert.Equal(t, int32(0), atomic.LoadInt32(&running))
+		assert.NoError(t, app.probes.healthy(time.Now()), "followers are healthy")
+
+		cancel()
+		<-done
+		_, released := lock.state()
+		assert.False(t, released, "a lost lock isn't released")
+	})
+
+	t.Run("cancellation releases the lock", func(t *testing.T) {
+		var (
+			app     = newApp()
+			lock    = &fakeLock{acquireCh: make(chan struct{})}
+			running int32
+		)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			app.campaign(ctx, lock, run(&running))
+			close(done)
+		}()
+
+		<-lock.acquireCh
+		assert.Eventually(t, func() bool { return atomic.LoadInt32(&running) == 1 }, time.Second, time.Millisecond)
+
+		cancel()
+		<-done
+		assert.Equal(t, int32(0), atomic.LoadInt32(&running))
+		_, released := lock.state()
+		assert.True(t, released)
+	})
+}
+
+func TestRunLocked(t *testing.T) {
+	app := &App{lo: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	t.Run("runs while holding the lock", func(t *testing.T) {
+		lock := &fakeLock{acquireCh: make(chan struct{})}
+		ran := false
+		assert.NoError(t, app.runLockedWith(context.Background(), lock, func(context.Context) error {
+			ran = true
+			return nil
+		}))
+		assert.True(t, ran)
+		_, released := lock.state()
+		assert.True(t, released)
+	})
+
+	t.Run("refuses to run while the lock is held", func(t *testing.T) {
+		lock := &fakeLock{acquired: true}
+		err := app.runLockedWith(context.Background(), lock, func(context.Context) error {
+			t.Fatal("the command must not run")
+			return nil
+		})
+		assert.ErrorIs(t, err, errLockLost)
+	})
+
+	t.Run("lost lock cancels the command", func(t *testing.T) {
+		lock := &fakeLock{maxRenew: 1, acquireCh: make(chan struct{})}
+		err := app.runLockedWith(context.Background(), lock, func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		assert.ErrorIs(t, err, errLockLost)
+	})
+}
+
+func TestStepDownBeforeTTL(t *testing.T) {
+	const ttl = 300 * time.Millisecond
+	app := &App{lo: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	t.Run("leader", func(t *testing.T) {
+		var (
+			lock    = &fakeLock{hang: true, lockTTL: ttl}
+			stopped time.Time
+			start   = time.Now()
+		)
+		app.lead(context.Background(), lock, func(ctx context.Context, wg *sync.WaitGroup) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-ctx.Done()
+				stopped = time.Now()
+			}()
+		})
+		assert.Less(t, stopped.Sub(start), ttl, "the workers must stop before the lock expires")
+	})
+
+	t.Run("one-shot command", func(t *testing.T) {
+		var (
+			lock  = &fakeLock{hang: true, lockTTL: ttl, acquireCh: make(chan struct{})}
+			start = time.Now()
+		)
+		err := app.runLockedWith(context.Background(), lock, func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		assert.ErrorIs(t, err, errLockLost)
+		assert.Less(t, time.Since(start), ttl, "the command must stop before the lock expires")
+	})
+}
+
+func TestNomadLock(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		holder string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		var v api.Variable
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&v))
+		assert.Equal(t, "/v1/var/nomad-external-dns/leader", r.URL.Path)
+
+		switch {
+		case r.URL.Query().Has("lock-acquire"):
+			if holder != "" {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			assert.Equal(t, "15s", v.Lock.TTL)
+			holder = "lock-id"
+			v.Lock.ID = holder
+			assert.NoError(t, json.NewEncoder(w).Encode(v))
+		case r.URL.Query().Has("lock-renew"), r.URL.Query().Has("lock-release"):
+			if v.Lock == nil || v.Lock.ID != holder {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			if r.URL.Query().Has("lock-release") {
+				holder = ""
+			}
+			assert.NoError(t, json.NewEncoder(w).Encode(v))
+		}
+	}))
+	defer srv.Close()
+
+	client, err := api.NewClient(&api.Config{Address: srv.URL})
+	require.NoError(t, err)
+
+	src := newNomadSource("default", "global", client)
+	leader, err := initLeaderLock(src, "nomad-external-dns/leader", "default", 0, 0)
+	require.NoError(t, err)
+	follower, err := initLeaderLock(src, "nomad-external-dns/leader", "default", 0, 0)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	acquired, err := leader.acquire(ctx)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+
+	acquired, err = follower.acquire(ctx)
+	assert.NoError(t, err)
+	assert.False(t, acquired, "the lock is held by the leader")
+	assert.ErrorIs(t, follower.renew(ctx), errLockLost)
+
+	assert.NoError(t, leader.renew(ctx))
+	assert.NoError(t, leader.release(ctx))
+
+	acquired, err = follower.acquire(ctx)
+	assert.NoError(t, err)
+	assert.True(t, acquired, "the lock is free once released")
+
+	_, err = initLeaderLock(src, "", "default", 0, 0)
+	assert.Error(t, err)
+}
@@ -18,7 +18,7 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	ko := initConfig(cfgPath, "NOMAD_EXTERNAL_DNS_")
+	ko, args := initConfig(cfgPath, "NOMAD_EXTERNAL_DNS_")
 
 	app, err := initApp(ko)
 	if err != nil {
@@ -26,5 +26,7 @@ func main() {
 	}
 
 	app.lo.Info("Starting nomad-external-dns", "version", buildString)
-	app.Start(ctx)
+	code := app.runCommand(ctx, args, os.Stdin, os.Stdout)
+	stop()
+	os.Exit(code)
 }
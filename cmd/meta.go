@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// cachedJob holds a job fetched from Nomad along with the index of the response.
+// The job reflects all changes up to the index, so it's valid for registrations made until then.
+type cachedJob struct {
+	index uint64
+	job   *api.Job
+}
+
+// metaPrefix returns the prefix of annotations in the meta blocks, which uses a `.` instead of the trailing `/`
+// of the annotation prefix, like `external-dns.hostname`.
+func metaPrefix(prefix string) string {
+	return strings.TrimRight(prefix, "/.") + "."
+}
+
+// parseMetaAnnotations parses the annotations from the keys of a meta block with the given prefix.
+func parseMetaAnnotations(prefix string, meta map[string]string) annotations {
+	a := make(annotations)
+	for k, v := range meta {
+		if key := strings.TrimPrefix(k, prefix); key != k && key != "" {
+			a[key] = []string{v}
+		}
+	}
+	return a
+}
+
+// merge adds the annotations of `other` whose keys aren't set yet, so that the receiver takes precedence.
+func (a annotations) merge(other annotations) {
+	for k, v := range other {
+		if _, ok := a[k]; !ok {
+			a[k] = v
+		}
+	}
+}
+
+// jobMeta returns the meta blocks which apply to a service, from the most to the least specific:
+// the service itself, its task (for task level services), its group and the job.
+// Services whose name is interpolated by Nomad can't be matched, so only the job meta applies to them.
+func jobMeta(job *api.Job, service string) []map[string]string {
+	for _, tg := range job.TaskGroups {
+		for _, s := range tg.Services {
+			if s.Name == service {
+				return []map[string]string{s.Meta, tg.Meta, job.Meta}
+			}
+		}
+		for _, t := range tg.Tasks {
+			for _, s := range t.Services {
+				if s.Name == service {
+					return []map[string]string{s.Meta, t.Meta, tg.Meta, job.Meta}
+				}
+			}
+		}
+	}
+	return []map[string]string{job.Meta}
+}
+
+// mergeMeta merges the meta blocks into a single map, where the earlier blocks take precedence.
+func mergeMeta(blocks []map[string]string) map[string]string {
+	meta := make(map[string]string)
+	for i := len(blocks) - 1; i >= 0; i-- {
+		for k, v := range blocks[i] {
+			meta[k] = v
+		}
+	}
+	return meta
+}
+
+// applyJobMeta adds the meta of the job, group and service to the service, along with the annotations in them.
+// Annotated tags take precedence over the meta annotations.
+func (app *App) applyJobMeta(ctx context.Context, src *nomadSource, svc *ServiceMeta, index uint64) error {
+	job, err := app.fetchJob(ctx, src, svc.Namespace, svc.Job, index)
+	if err != nil {
+		return err
+	}
+
+	blocks := jobMeta(job, svc.Name)
+	for _, meta := range blocks {
+		svc.Annotations.merge(parseMetaAnnotations(metaPrefix(app.opts.annotationPrefix), meta))
+	}
+	svc.Meta = mergeMeta(blocks)
+	return nil
+}
+
+// fetchJob fetches a job from Nomad. A cached job is reused for registrations up to the index
+// at which it was fetched, so that services of the same job don't fetch it again.
+func (app *App) fetchJob(ctx context.Context, src *nomadSource, namespace, jobID string, index uint64) (*api.Job, error) {
+	key := serviceCacheKey(namespace, jobID)
+
+	src.cacheMu.Lock()
+	cached, ok := src.jobCache[key]
+	src.cacheMu.Unlock()
+	if ok && index <= cached.index {
+		return cached.job, nil
+	}
+
+	q := &api.QueryOptions{Namespace: namespace}
+	job, meta, err := src.client.Jobs().Info(jobID, q.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("error fetching job %s: %w", jobID, err)
+	}
+
+	src.cacheMu.Lock()
+	src.jobCache[key] = cachedJob{index: meta.LastIndex, job: job}
+	src.cacheMu.Unlock()
+
+	return job, nil
+}
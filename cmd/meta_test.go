@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hashicorp/nomad/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobMetaAnnotations(t *testing.T) {
+	job := &api.Job{
+		Meta: map[string]string{"external-dns.ttl": "5m", "external-dns.srv": "true", "team": "core"},
+		TaskGroups: []*api.TaskGroup{
+			{
+				Meta:     map[string]string{"external-dns.ttl": "1m"},
+				Services: []*api.Service{{Name: "web", Meta: map[string]string{"external-dns.hostname": "web.test.internal,www.test.internal"}}},
+				Tasks: []*api.Task{
+					{
+						Meta:     map[string]string{"external-dns.target": "lb.example.com"},
+						Services: []*api.Service{{Name: "api"}},
+					},
+				},
+			},
+		},
+	}
+
+	// Tags take precedence over the service meta, followed by the group and job meta.
+	svc := &ServiceMeta{Annotations: parseAnnotations(DefaultAnnotationPrefix, []string{"external-dns/srv=false"})}
+	for _, meta := range jobMeta(job, "web") {
+		svc.Annotations.merge(parseMetaAnnotations(metaPrefix(DefaultAnnotationPrefix), meta))
+	}
+	assert.Equal(t, annotations{
+		"hostname": {"web.test.internal,www.test.internal"},
+		"ttl":      {"1m"},
+		"srv":      {"false"},
+	}, svc.Annotations)
+	assert.Equal(t, []string{"web.test.internal", "www.test.internal"}, getDNSNames(svc.Annotations))
+
+	// Task level services get the task meta.
+	blocks := jobMeta(job, "api")
+	assert.Len(t, blocks, 4)
+	assert.Equal(t, map[string]string{
+		"external-dns.ttl":    "1m",
+		"external-dns.srv":    "true",
+		"external-dns.target": "lb.example.com",
+		"team":                "core",
+	}, mergeMeta(blocks))
+
+	// Unknown services only get the job meta.
+	assert.Equal(t, []map[string]string{job.Meta}, jobMeta(job, "unknown"))
+
+	assert.Equal(t, "public-dns.", metaPrefix("public-dns/"))
+}
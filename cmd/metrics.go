@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+func init() {
+	// Expose the TYPE of the metrics, so that the gauges aren't treated as untyped by Prometheus.
+	metrics.ExposeMetadata(true)
+}
+
+// incDryRunChanges counts a distinct change which was planned but not applied because of dry run mode.
+func incDryRunChanges(action, zone string) {
+	metrics.GetOrCreateCounter(fmt.Sprintf(`nomad_external_dns_dry_run_changes_total{action=%q,zone=%q}`, action, zone)).Inc()
+}
+
+// incPruneGuardTripped counts a prune whose deletions were refused for exceeding the deletion thresholds.
+func incPruneGuardTripped(provider string) {
+	metrics.GetOrCreateCounter(fmt.Sprintf(`nomad_external_dns_prune_guard_tripped_total{provider=%q}`, provider)).Inc()
+}
+
+// setLeader sets whether this instance is the leader and runs the workers.
+func setLeader(leader bool) {
+	v := 0.0
+	if leader {
+		v = 1
+	}
+	metrics.GetOrCreateGauge("nomad_external_dns_leader", nil).Set(v)
+}
+
+// observeNomadFetch records the latency of fetching the services of a Nomad source, and counts the failed fetches.
+func observeNomadFetch(source string, start time.Time, err error) {
+	metrics.GetOrCreatePrometheusHistogram(fmt.Sprintf(`nomad_external_dns_nomad_fetch_duration_seconds{source=%q}`, source)).UpdateDuration(start)
+	if err != nil {
+		metrics.GetOrCreateCounter(fmt.Sprintf(`nomad_external_dns_nomad_fetch_errors_total{source=%q}`, source)).Inc()
+	}
+}
+
+// observeProviderCall records the latency of a call to a DNS provider, and counts the failed calls.
+func observeProviderCall(provider, operation, zone string, start time.Time, err error) {
+	labels := fmt.Sprintf(`{provider=%q,operation=%q,zone=%q}`, provider, operation, zone)
+	metrics.GetOrCreatePrometheusHistogram("nomad_external_dns_provider_request_duration_seconds" + labels).UpdateDuration(start)
+	if err != nil {
+		metrics.GetOrCreateCounter("nomad_external_dns_provider_errors_total" + labels).Inc()
+	}
+}
+
+// setManagedRecords sets the number of record sets owned by this program in a zone.
+func setManagedRecords(provider, zone string, count int) {
+	metrics.GetOrCreateGauge(fmt.Sprintf(`nomad_external_dns_managed_records{provider=%q,zone=%q}`, provider, zone), nil).Set(float64(count))
+}
+
+// setServices sets the number of services seen in a Nomad source and the number of those which are exported.
+func setServices(source string, seen, exported int) {
+	metrics.GetOrCreateGauge(fmt.Sprintf(`nomad_external_dns_services{source=%q,state="seen"}`, source), nil).Set(float64(seen))
+	metrics.GetOrCreateGauge(fmt.Sprintf(`nomad_external_dns_services{source=%q,state="exported"}`, source), nil).Set(float64(exported))
+}
+
+// setLastSuccess sets the timestamp of the last successful run of a worker, i.e. the sync or prune.
+func setLastSuccess(worker string, t time.Time) {
+	metrics.GetOrCreateGauge(fmt.Sprintf(`nomad_external_dns_last_success_timestamp_seconds{worker=%q}`, worker), nil).Set(float64(t.Unix()))
+}
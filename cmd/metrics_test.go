@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	observeProviderCall("metrics-test", "get", "test.internal.", time.Now(), errors.New("failed"))
+	setManagedRecords("metrics-test", "test.internal.", 3)
+	setManagedRecords("metrics-test", "test.internal.", 2)
+
+	var buf bytes.Buffer
+	metrics.WritePrometheus(&buf, false)
+	out := buf.String()
+
+	// Latencies are exported with the Prometheus `le` buckets, which histogram_quantile() works with.
+	assert.Contains(t, out, `nomad_external_dns_provider_request_duration_seconds_bucket{provider="metrics-test",operation="get",zone="test.internal.",le="+Inf"} 1`)
+	assert.NotContains(t, out, "vmrange")
+	assert.Contains(t, out, `nomad_external_dns_provider_errors_total{provider="metrics-test",operation="get",zone="test.internal."} 1`)
+
+	// Gauges are exported as such and can go down.
+	assert.Contains(t, out, "# TYPE nomad_external_dns_managed_records gauge")
+	assert.Contains(t, out, `nomad_external_dns_managed_records{provider="metrics-test",zone="test.internal."} 2`)
+}
@@ -6,23 +6,77 @@ import (
 	"github.com/libdns/libdns"
 )
 
+// Annotation keys, which are prefixed with the annotation prefix (`external-dns/` by default) in the tags.
 const (
-	// HostnameAnnotationKey is the annotated tag for defining hostname.
-	HostnameAnnotationKey = "external-dns/hostname"
-	// TTLAnnotationKey is the annotated tag for defining TTL.
-	TTLAnnotationKey = "external-dns/ttl"
+	// HostnameAnnotationKey is the annotation for defining hostname.
+	HostnameAnnotationKey = "hostname"
+	// TTLAnnotationKey is the annotation for defining TTL.
+	TTLAnnotationKey = "ttl"
+	// CloudflareProxiedAnnotationKey is the annotation for toggling Cloudflare's proxy for the records.
+	CloudflareProxiedAnnotationKey = "cloudflare-proxied"
+	// SRVAnnotationKey is the annotation for publishing SRV records for the service.
+	SRVAnnotationKey = "srv"
+	// SRVProtocolAnnotationKey is the annotation for defining the protocol label of SRV records.
+	SRVProtocolAnnotationKey = "srv-protocol"
+	// SRVPriorityAnnotationKey is the annotation for defining the priority of SRV records.
+	SRVPriorityAnnotationKey = "srv-priority"
+	// SRVWeightAnnotationKey is the annotation for defining the weight of SRV records.
+	SRVWeightAnnotationKey = "srv-weight"
+	// AddressFamilyAnnotationKey is the annotation for restricting the records to one address family.
+	AddressFamilyAnnotationKey = "address-family"
+	// TargetAnnotationKey is the annotation for publishing a CNAME to a target instead of the addresses of the service.
+	TargetAnnotationKey = "target"
+	// OwnershipRecordPrefix is the label prefixed to the name of the TXT ownership record of a CNAME,
+	// as no other record can exist at the same name as a CNAME.
+	OwnershipRecordPrefix = "_external-dns"
+	// HealthyOnlyAnnotationKey is the annotation for only publishing allocations whose checks are passing.
+	HealthyOnlyAnnotationKey = "healthy-only"
+	// AutoHostnameAnnotationKey is the annotation for deriving the hostname of a service from the hostname template.
+	AutoHostnameAnnotationKey = "auto-hostname"
 	// DefaultTTL is the TTL to set for records if unspecified or unparseable.
 	DefaultTTL = time.Second * 30
+	// DefaultSRVProtocol is the protocol label of SRV records if unspecified.
+	DefaultSRVProtocol = "tcp"
+	// DefaultSRVPriority is the priority of SRV records if unspecified or unparseable.
+	DefaultSRVPriority = 10
+	// DefaultSRVWeight is the weight of SRV records if unspecified or unparseable.
+	DefaultSRVWeight = 10
+
+	// AddressFamilyIPv4 restricts the records of a service to A records.
+	AddressFamilyIPv4 = "ipv4"
+	// AddressFamilyIPv6 restricts the records of a service to AAAA records.
+	AddressFamilyIPv6 = "ipv6"
 )
 
 // ServiceMeta contains minimal items from a api.ServiceRegistration event.
 type ServiceMeta struct {
-	Name      string   // Human Name of the service.
-	Namespace string   // Namespace to which the service belongs to.
-	Job       string   // Job to which the service belongs to.
-	Addresses []string // Address of all backend services which is fetched by calling Nomad HTTP API.
-	Tags      []string // Tags in the given service.
-	DNSName   string   // DNS name of the service.
+	Name       string   // Human Name of the service.
+	Namespace  string   // Namespace to which the service belongs to.
+	Job        string   // Job to which the service belongs to.
+	Datacenter string   // Datacenter in which the service is registered.
+	Cluster    string   // Name of the Nomad source from which the service is exported.
+	Region     string   // Region of the Nomad source from which the service is exported.
+	Addresses  []string // Address of all backend services which is fetched by calling Nomad HTTP API.
+	Tags       []string // Tags in the given service.
+	// Annotations are the annotated tags of the service, parsed with the configured prefix,
+	// followed by the annotations in the meta of the service, its group and job.
+	Annotations annotations
+	// Meta is the meta of the service merged with the meta of its task, group and job, if enabled.
+	Meta     map[string]string
+	DNSNames []string // All DNS names of the service, from the hostname annotation or the hostname template.
+	DNSName  string   // DNS name of the service. A service with several hostnames has one ServiceMeta per hostname.
+
+	Endpoints []Endpoint // Address and port of every allocation of the service, sorted by allocation ID.
+	// Unhealthy is set when none of the allocations of the service with health checking enabled are healthy.
+	// Its records are withdrawn, unless failing open, in which case all of its allocations are kept.
+	Unhealthy bool
+}
+
+// Endpoint is the address and port of a single allocation of a service.
+type Endpoint struct {
+	AllocID string
+	Address string
+	Port    int
 }
 
 // DNSProvider wraps the required libdns interfaces.
@@ -33,9 +87,22 @@ type DNSProvider interface {
 	libdns.RecordDeleter
 }
 
+// ttlLimiter is implemented by the DNS providers which raise the TTL of records below a minimum.
+type ttlLimiter interface {
+	minTTL() time.Duration
+}
+
+// providerInstance is a configured DNS provider along with the zones it owns.
+type providerInstance struct {
+	name     string
+	provider DNSProvider
+	domains  []string
+}
+
 // RecordMeta wraps around `libdns.Record`
 // and adds additional fields.
 type RecordMeta struct {
 	Records []libdns.Record
 	Zone    string
+	Proxied *bool // Cloudflare proxy setting for the records. Uses the provider default if nil.
 }
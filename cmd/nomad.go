@@ -1,77 +1,424 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/nomad/api"
 )
 
-// fetchNomadServices retrieves all services from the Nomad API
-// and returns a map where of services where the key is the unique ID of the service.
-func (app *App) fetchNomadServices() (map[string]ServiceMeta, error) {
-	services := make(map[string]ServiceMeta)
+const (
+	// defaultMaxConcurrentFetches is the number of services fetched in parallel if unspecified.
+	defaultMaxConcurrentFetches = 10
+	// serviceWaitTime bounds how long a blocking query for a single service waits for the requested index.
+	serviceWaitTime = time.Second * 10
+)
+
+// cachedService holds the last fetched state of a Nomad service.
+type cachedService struct {
+	index     uint64       // Highest ModifyIndex across all registrations of the service.
+	count     int          // Number of registrations. Detects deregistrations which don't move the highest index.
+	lastIndex uint64       // Index of the Nomad state the registrations were read at. The entry reflects all changes up to it.
+	job       string       // Cache key of the job of the registrations. Jobs no longer referenced are dropped from the job cache.
+	meta      *ServiceMeta // Metadata of the service. nil if the service isn't annotated or is gone.
+}
+
+// nomadSource is a Nomad cluster (or a region of a federated cluster) from which services are exported.
+// Each source keeps its own cache, as indexes aren't comparable across clusters.
+type nomadSource struct {
+	name   string // Unique name of the source, recorded as `cluster` in the ownership records.
+	region string // Region of the source, recorded as `region` in the ownership records.
+	client *api.Client
+
+	// cacheMu guards the cache of services fetched from Nomad.
+	cacheMu     sync.Mutex
+	svcCache    map[string]cachedService
+	listIndex   uint64
+	nodeClasses map[string]string
+	// nodesListedAt is the time at which the classes of the nodes were last listed.
+	nodesListedAt time.Time
+	jobCache      map[string]cachedJob
+	// synced is set once the services of the source have been fetched successfully.
+	// Records of a source are only pruned after that, so that an unreachable cluster doesn't lose its records on boot.
+	synced bool
+
+	// subscription is incremented every time the event stream is (re)subscribed, and eventIndex is the index
+	// up to which the events of the current subscription were reconciled into the cache.
+	// fetchedSubscription is the subscription during which the services were last fetched from the list.
+	// Events missed between two subscriptions can't be detected, so the cache is only trusted to be
+	// kept current by events once the services were fetched during the current subscription.
+	subscription        int
+	fetchedSubscription int
+	eventIndex          uint64
+}
+
+// newNomadSource creates a source with empty caches.
+func newNomadSource(name, region string, client *api.Client) *nomadSource {
+	return &nomadSource{
+		name:        name,
+		region:      region,
+		client:      client,
+		svcCache:    make(map[string]cachedService, 0),
+		nodeClasses: make(map[string]string, 0),
+		jobCache:    make(map[string]cachedJob, 0),
+	}
+}
+
+// serviceRef identifies a service in a Nomad cluster.
+type serviceRef struct {
+	namespace string
+	name      string
+}
+
+// serviceCacheKey returns the key used to cache a service, as service names are only unique within a namespace.
+func serviceCacheKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// fetchNomadServices retrieves all services from every Nomad source and merges them
+// into a map of services keyed by their DNS name.
+// The sources are fetched in parallel, as the list of services of each of them is a blocking query.
+// If a source can't be reached, its last known services are used so that its records aren't pruned.
+// If several sources publish the same hostname, the source configured first wins.
+// It returns an error only if no source could be fetched.
+func (app *App) fetchNomadServices(ctx context.Context) (map[string]ServiceMeta, error) {
+	var (
+		wg         sync.WaitGroup
+		srcResults = make([]map[string]ServiceMeta, len(app.sources))
+		srcErrors  = make([]error, len(app.sources))
+	)
+	for i, src := range app.sources {
+		wg.Add(1)
+		go func(i int, src *nomadSource) {
+			defer wg.Done()
+
+			start := time.Now()
+			srcResults[i], srcErrors[i] = app.fetchSourceServices(ctx, src)
+			observeNomadFetch(src.name, start, srcErrors[i])
+		}(i, src)
+	}
+	wg.Wait()
+
+	var (
+		services = make(map[string]ServiceMeta)
+		failed   = 0
+	)
+	for i, src := range app.sources {
+		srcServices, err := srcResults[i], srcErrors[i]
+		if err != nil {
+			app.lo.Error("Failed to fetch services from source, using last known services", "source", src.name, "error", err)
+			srcServices = src.cachedServices()
+			failed++
+		}
+
+		for key, svc := range srcServices {
+			if existing, ok := services[key]; ok {
+				app.lo.Warn("Hostname is published by several sources, ignoring duplicate", "dns", key, "source", src.name, "published_by", existing.Cluster)
+				continue
+			}
+			services[key] = svc
+		}
+	}
 
+	if failed == len(app.sources) {
+		return nil, fmt.Errorf("error fetching services from all sources")
+	}
+	app.probes.nomadFetched(time.Now())
+	return services, nil
+}
+
+// fetchSourceServices retrieves all services from the Nomad API of a source
+// and returns a map of services where the key is the DNS name of the service.
+// Services are only re-fetched if the index of the service list has moved since the last call
+// and only annotated services are fetched individually, with a bounded concurrency.
+// The list doesn't carry the index of each service, so a cached service is only reused if it was read
+// at or after the index of the list, or if the event stream has reconciled every change up to it.
+func (app *App) fetchSourceServices(ctx context.Context, src *nomadSource) (map[string]ServiceMeta, error) {
 	// Fetch the list of services
-	serviceList, err := app.fetchServiceList()
+	serviceList, index, err := app.fetchServiceList(ctx, src)
 	if err != nil {
 		return nil, err
 	}
 
-	// Iterate over each service to fetch its metadata
+	src.cacheMu.Lock()
+	unchanged := index != 0 && index == src.listIndex
+	subscription := src.subscription
+	eventsCurrent := app.opts.watchEvents && subscription != 0 &&
+		src.fetchedSubscription == subscription && src.eventIndex >= index
+	src.cacheMu.Unlock()
+
+	if unchanged {
+		app.lo.Debug("Service list unchanged, using cached services", "source", src.name, "index", index)
+		return src.cachedServices(), nil
+	}
+
+	// Collect the services which have a hostname annotation in any of their registrations, or use the hostname template.
+	// The tags in the list stub are a union of tags across all registrations of a service.
+	var (
+		wanted = make(map[string]struct{})
+		refs   = make([]serviceRef, 0)
+		seen   = 0
+	)
+	// If annotations are read from the job meta, every service has to be fetched.
 	for _, l := range serviceList {
+		if !app.opts.filters.matchNamespace(l.Namespace) {
+			continue
+		}
 		for _, s := range l.Services {
-			svcMeta, err := app.fetchServiceMeta(l.Namespace, s.ServiceName)
-			if err != nil {
-				return nil, err
+			seen++
+			if !app.opts.metaAnnotations && !app.isExported(l.Namespace, parseAnnotations(app.opts.annotationPrefix, s.Tags)) {
+				continue
 			}
+			wanted[serviceCacheKey(l.Namespace, s.ServiceName)] = struct{}{}
+			refs = append(refs, serviceRef{namespace: l.Namespace, name: s.ServiceName})
+		}
+	}
+
+	setServices(src.name, seen, len(refs))
 
-			// If metadata exists, store it in the services map.
-			if svcMeta != nil {
-				services[EnsureFQDN(svcMeta.DNSName)] = *svcMeta
+	// Skip the services whose cached state already reflects the index of the list.
+	src.cacheMu.Lock()
+	stale := make([]serviceRef, 0, len(refs))
+	for _, ref := range refs {
+		cached, ok := src.svcCache[serviceCacheKey(ref.namespace, ref.name)]
+		if ok && (eventsCurrent || cached.lastIndex >= index) {
+			continue
+		}
+		stale = append(stale, ref)
+	}
+	src.cacheMu.Unlock()
+
+	app.lo.Debug("Fetching changed services", "source", src.name, "wanted", len(refs), "stale", len(stale), "events_current", eventsCurrent)
+
+	// Iterate over each service to fetch its metadata.
+	var (
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, app.opts.maxConcurrentFetches)
+		errOnce  sync.Once
+		fetchErr error
+	)
+	for _, ref := range stale {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(ref serviceRef) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if _, err := app.fetchServiceMeta(ctx, src, ref.namespace, ref.name, 0); err != nil {
+				errOnce.Do(func() { fetchErr = err })
 			}
+		}(ref)
+	}
+	wg.Wait()
+
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+
+	// Drop services which are no longer present in the cluster, along with the jobs which none of the remaining
+	// services belong to, and record the index only after all the services were fetched successfully.
+	src.cacheMu.Lock()
+	jobs := make(map[string]struct{}, len(src.jobCache))
+	for key, c := range src.svcCache {
+		if _, ok := wanted[key]; !ok {
+			delete(src.svcCache, key)
+			continue
 		}
+		jobs[c.job] = struct{}{}
 	}
+	for key := range src.jobCache {
+		if _, ok := jobs[key]; !ok {
+			delete(src.jobCache, key)
+		}
+	}
+	src.listIndex = index
+	src.fetchedSubscription = subscription
+	src.synced = true
+	src.cacheMu.Unlock()
 
-	return services, nil
+	return src.cachedServices(), nil
 }
 
-// fetchServiceList retrieves the list of services from the Nomad API.
-func (app *App) fetchServiceList() ([]*api.ServiceRegistrationListStub, error) {
-	servicesList, _, err := app.nomadClient.Services().List(&api.QueryOptions{Namespace: "*"})
+// cachedServices builds the map of annotated services keyed by their DNS name from the service cache.
+// A service with several hostnames has an entry for each of them.
+func (src *nomadSource) cachedServices() map[string]ServiceMeta {
+	src.cacheMu.Lock()
+	defer src.cacheMu.Unlock()
+
+	services := make(map[string]ServiceMeta, len(src.svcCache))
+	for _, c := range src.svcCache {
+		// If metadata exists, store it in the services map.
+		if c.meta == nil {
+			continue
+		}
+		for key, svc := range c.meta.byHostname() {
+			services[key] = svc
+		}
+	}
+	return services
+}
+
+// fetchServiceList retrieves the list of services from the Nomad API along with the index of the list.
+// Once the list has been fetched, it's a blocking query from the index of the last fetch, which returns as soon
+// as a service changes, or once the update interval has passed without changes.
+func (app *App) fetchServiceList(ctx context.Context, src *nomadSource) ([]*api.ServiceRegistrationListStub, uint64, error) {
+	q := &api.QueryOptions{Namespace: "*"}
+	src.cacheMu.Lock()
+	if src.listIndex > 0 && app.opts.updateInterval > 0 {
+		q.WaitIndex = src.listIndex
+		q.WaitTime = app.opts.updateInterval
+	}
+	src.cacheMu.Unlock()
+
+	servicesList, meta, err := src.client.Services().List(q.WithContext(ctx))
 	if err != nil {
-		return nil, fmt.Errorf("error listing services: %w", err)
+		return nil, 0, fmt.Errorf("error listing services: %w", err)
 	}
-	app.lo.Debug("Fetched service list with count", "count", len(servicesList))
-	return servicesList, nil
+	app.lo.Debug("Fetched service list with count", "source", src.name, "count", len(servicesList), "index", meta.LastIndex)
+	return servicesList, meta.LastIndex, nil
 }
 
-// fetchServiceMeta fetches the metadata for a single service.
-func (app *App) fetchServiceMeta(namespace, serviceName string) (*ServiceMeta, error) {
+// fetchServiceMeta fetches the metadata for a single service and stores it in the service cache.
+// If `waitIndex` is non-zero, the cached service is used if it already reflects that index. Otherwise
+// a blocking query is made, so that the response reflects at least that index even if it's served by a lagging server.
+// The metadata is only rebuilt if the registrations of the service have changed.
+func (app *App) fetchServiceMeta(ctx context.Context, src *nomadSource, namespace, serviceName string, waitIndex uint64) (*ServiceMeta, error) {
+	key := serviceCacheKey(namespace, serviceName)
+
+	q := &api.QueryOptions{Namespace: namespace}
+	if waitIndex > 0 {
+		src.cacheMu.Lock()
+		cached, ok := src.svcCache[key]
+		src.cacheMu.Unlock()
+		if ok && cached.lastIndex >= waitIndex {
+			return cached.meta, nil
+		}
+
+		// A blocking query returns once the index is greater than `WaitIndex`.
+		q.WaitIndex = waitIndex - 1
+		q.WaitTime = serviceWaitTime
+	}
+
 	// Fetch the service details
-	svcRegistrations, _, err := app.nomadClient.Services().Get(serviceName, &api.QueryOptions{Namespace: namespace})
+	svcRegistrations, qm, err := src.client.Services().Get(serviceName, q.WithContext(ctx))
 	if err != nil {
 		return nil, fmt.Errorf("error fetching service detail: %w", err)
 	}
 
-	// If there are no service registrations or no tags, return nil.
-	if len(svcRegistrations) == 0 || len(svcRegistrations[0].Tags) == 0 {
+	// Drop the registrations which are filtered out by the config.
+	svcRegistrations, err = app.filterRegistrations(ctx, src, svcRegistrations)
+	if err != nil {
+		return nil, fmt.Errorf("error filtering service registrations: %w", err)
+	}
+
+	// If there are no service registrations, the service is gone. The entry is kept without metadata,
+	// so that further deregistration events at the same index don't fetch it again.
+	if len(svcRegistrations) == 0 {
+		src.cacheMu.Lock()
+		src.svcCache[key] = cachedService{lastIndex: qm.LastIndex}
+		src.cacheMu.Unlock()
 		return nil, nil
 	}
 
-	// Check if the service has a hostname annotation, if not, ignore the service.
-	if !hasHostnameAnnotation(svcRegistrations[0].Tags) {
-		app.lo.Debug("Hostname not found in tags, ignoring service", "service", svcRegistrations[0].ServiceName)
+	index := maxModifyIndex(svcRegistrations)
+	job := serviceCacheKey(namespace, svcRegistrations[0].JobID)
+
+	src.cacheMu.Lock()
+	cached, ok := src.svcCache[key]
+	if ok && cached.index == index && cached.count == len(svcRegistrations) {
+		cached.lastIndex = qm.LastIndex
+		src.svcCache[key] = cached
+		src.cacheMu.Unlock()
+		return cached.meta, nil
+	}
+	src.cacheMu.Unlock()
+
+	svcMeta, err := app.buildServiceMeta(ctx, src, svcRegistrations, index)
+	if err != nil {
+		return nil, err
+	}
+
+	src.cacheMu.Lock()
+	src.svcCache[key] = cachedService{index: index, count: len(svcRegistrations), lastIndex: qm.LastIndex, job: job, meta: svcMeta}
+	src.cacheMu.Unlock()
+
+	return svcMeta, nil
+}
+
+// buildServiceMeta creates a ServiceMeta object from the registrations of a service.
+// If enabled, the annotations in the meta of the service, its group and job are added to the annotated tags.
+// It returns nil if the service isn't annotated for DNS.
+func (app *App) buildServiceMeta(ctx context.Context, src *nomadSource, svcRegistrations []*api.ServiceRegistration, index uint64) (*ServiceMeta, error) {
+	svcMeta := &ServiceMeta{
+		Name:        svcRegistrations[0].ServiceName,
+		Namespace:   svcRegistrations[0].Namespace,
+		Job:         svcRegistrations[0].JobID,
+		Datacenter:  svcRegistrations[0].Datacenter,
+		Cluster:     src.name,
+		Region:      src.region,
+		Tags:        svcRegistrations[0].Tags,
+		Annotations: parseAnnotations(app.opts.annotationPrefix, svcRegistrations[0].Tags),
+		Addresses:   uniqueAddresses(svcRegistrations),
+		Endpoints:   serviceEndpoints(svcRegistrations),
+	}
+
+	if app.opts.metaAnnotations {
+		if err := app.applyJobMeta(ctx, src, svcMeta, index); err != nil {
+			return nil, err
+		}
+	}
+
+	// Check if the service has a hostname annotation or uses the hostname template, if not, ignore the service.
+	if !app.isExported(svcMeta.Namespace, svcMeta.Annotations) {
+		app.lo.Debug("Hostname not found in tags, ignoring service", "service", svcMeta.Name)
 		return nil, nil
 	}
 
-	// Create a ServiceMeta object and return its reference.
-	svcMeta := ServiceMeta{
-		Name:      svcRegistrations[0].ServiceName,
-		Namespace: svcRegistrations[0].Namespace,
-		Job:       svcRegistrations[0].JobID,
-		Tags:      svcRegistrations[0].Tags,
-		Addresses: uniqueAddresses(svcRegistrations),
-		DNSName:   getDNSNameFromTags(svcRegistrations[0].Tags),
+	// Explicit hostnames take precedence over the template.
+	svcMeta.DNSNames = getDNSNames(svcMeta.Annotations)
+	if len(svcMeta.DNSNames) == 0 {
+		names, err := app.renderHostnames(svcMeta)
+		if err != nil {
+			app.lo.Error("Failed to derive hostname, ignoring service", "service", svcMeta.Name, "namespace", svcMeta.Namespace, "error", err)
+			return nil, nil
+		}
+		svcMeta.DNSNames = names
+	}
+
+	return svcMeta, nil
+}
+
+// byHostname returns a copy of the service for each of its hostnames, keyed by the fully qualified hostname.
+// Each copy has its DNSName set, so that the records of every hostname are tracked and pruned independently.
+func (s ServiceMeta) byHostname() map[string]ServiceMeta {
+	services := make(map[string]ServiceMeta, len(s.DNSNames))
+	for _, name := range s.DNSNames {
+		svc := s
+		svc.DNSName = name
+		services[EnsureFQDN(name)] = svc
 	}
-	return &svcMeta, nil
+	return services
+}
+
+// maxModifyIndex returns the highest ModifyIndex among the given registrations.
+func maxModifyIndex(svcRegistrations []*api.ServiceRegistration) uint64 {
+	var index uint64
+	for _, s := range svcRegistrations {
+		if s.ModifyIndex > index {
+			index = s.ModifyIndex
+		}
+	}
+	return index
+}
+
+// isSynced checks if the services of the source have been fetched successfully at least once.
+func (src *nomadSource) isSynced() bool {
+	src.cacheMu.Lock()
+	defer src.cacheMu.Unlock()
+	return src.synced
 }
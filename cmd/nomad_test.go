@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
+)
+
+// fakeServices is a Nomad API serving the service, job and event stream endpoints, which counts the calls to fetch
+// a single service. Every service belongs to a job of the same name.
+type fakeServices struct {
+	mu       sync.Mutex
+	index    uint64
+	services map[string][]*api.ServiceRegistration
+	gets     map[string]int
+	// events are the batches sent on the next subscription to the event stream, which is closed right after.
+	events []api.Events
+	// streams are the indexes the event stream was subscribed from.
+	streams []string
+	// lists are the indexes the list of services was blocked on.
+	lists []string
+}
+
+func (f *fakeServices) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.Header().Set("X-Nomad-Index", strconv.FormatUint(f.index, 10))
+	if r.URL.Path == "/v1/event/stream" {
+		f.streams = append(f.streams, r.URL.Query().Get("index"))
+		for _, events := range f.events {
+			_ = json.NewEncoder(w).Encode(events)
+		}
+		f.events = nil
+		return
+	}
+	if r.URL.Path == "/v1/services" {
+		f.lists = append(f.lists, r.URL.Query().Get("index"))
+		stub := &api.ServiceRegistrationListStub{Namespace: "default"}
+		for name, regs := range f.services {
+			stub.Services = append(stub.Services, &api.ServiceRegistrationStub{ServiceName: name, Tags: regs[0].Tags})
+		}
+		_ = json.NewEncoder(w).Encode([]*api.ServiceRegistrationListStub{stub})
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/v1/job/") {
+		id := strings.TrimPrefix(r.URL.Path, "/v1/job/")
+		_ = json.NewEncoder(w).Encode(&api.Job{ID: &id, Meta: map[string]string{"external-dns.ttl": "1m"}})
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/v1/service/")
+	f.gets[name]++
+	regs := f.services[name]
+	if regs == nil {
+		regs = []*api.ServiceRegistration{}
+	}
+	_ = json.NewEncoder(w).Encode(regs)
+}
+
+// set registers a service at the next index, or deregisters it if there are no addresses.
+func (f *fakeServices) set(name string, tags []string, addresses ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.index++
+	if len(addresses) == 0 {
+		delete(f.services, name)
+		return
+	}
+	regs := make([]*api.ServiceRegistration, 0, len(addresses))
+	for i, addr := range addresses {
+		regs = append(regs, &api.ServiceRegistration{
+			ID:          name + strconv.Itoa(i),
+			ServiceName: name,
+			Namespace:   "default",
+			JobID:       name,
+			Tags:        tags,
+			Address:     addr,
+			Port:        8080,
+			ModifyIndex: f.index,
+		})
+	}
+	f.services[name] = regs
+}
+
+// calls returns and resets the number of calls to fetch each service.
+func (f *fakeServices) calls() map[string]int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	gets := f.gets
+	f.gets = make(map[string]int)
+	return gets
+}
+
+// newFakeSource returns a Nomad source for the fake API, which is served until the end of the test.
+func newFakeSource(t *testing.T, fake *fakeServices) *nomadSource {
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	client, err := api.NewClient(&api.Config{Address: srv.URL})
+	require.NoError(t, err)
+	return newNomadSource("default", "", client)
+}
+
+func TestFetchSourceServices(t *testing.T) {
+	fake := &fakeServices{services: make(map[string][]*api.ServiceRegistration), gets: make(map[string]int)}
+	src := newFakeSource(t, fake)
+	app := &App{
+		lo: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		opts: Opts{
+			updateInterval:       time.Minute,
+			maxConcurrentFetches: 2,
+			annotationPrefix:     DefaultAnnotationPrefix,
+		},
+		sources: []*nomadSource{src},
+	}
+	ctx := context.Background()
+
+	fake.set("redis", []string{"external-dns/hostname=redis.test.internal"}, "10.0.0.1")
+	fake.set("web", []string{"external-dns/hostname=web.test.internal"}, "10.0.0.2")
+	fake.set("unannotated", nil, "10.0.0.3")
+
+	fetch := func() map[string]ServiceMeta {
+		services, err := app.fetchSourceServices(ctx, src)
+		require.NoError(t, err)
+		return services
+	}
+
+	// Only the annotated services are fetched.
+	services := fetch()
+	assert.Len(t, services, 2)
+	assert.Equal(t, map[string]int{"redis": 1, "web": 1}, fake.calls())
+
+	// Nothing is fetched while the list is unchanged. The list is a blocking query from the index of the last fetch.
+	fetch()
+	assert.Empty(t, fake.calls())
+	assert.Equal(t, []string{"", "3"}, fake.lists)
+
+	// Without events, the list doesn't tell which service changed, so all of them are fetched.
+	fake.set("web", []string{"external-dns/hostname=web.test.internal"}, "10.0.0.4")
+	services = fetch()
+	assert.Equal(t, []string{"10.0.0.4"}, services["web.test.internal."].Addresses)
+	assert.Equal(t, map[string]int{"redis": 1, "web": 1}, fake.calls())
+
+	// The first fetch after subscribing to events fetches every service, as events may have been missed.
+	app.opts.watchEvents = true
+	src.subscription++
+	fake.set("web", []string{"external-dns/hostname=web.test.internal"}, "10.0.0.5")
+	fetch()
+	assert.Equal(t, map[string]int{"redis": 1, "web": 1}, fake.calls())
+
+	// An event fetches the service once, further events up to the same index use the cache.
+	fake.set("web", []string{"external-dns/hostname=web.test.internal"}, "10.0.0.6", "10.0.0.7")
+	for i := 0; i < 2; i++ {
+		svc, err := app.fetchServiceMeta(ctx, src, "default", "web", fake.index)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"10.0.0.6", "10.0.0.7"}, svc.Addresses)
+	}
+	assert.Equal(t, map[string]int{"web": 1}, fake.calls())
+
+	// Once the events up to the index of the list are reconciled, only new services are fetched.
+	fake.set("api", []string{"external-dns/hostname=api.test.internal"}, "10.0.0.8")
+	src.eventIndex = fake.index
+	services = fetch()
+	assert.Len(t, services, 3)
+	assert.Equal(t, map[string]int{"api": 1}, fake.calls())
+
+	// Events lagging behind the list fall back to fetching the services read before its index.
+	fake.set("api", nil)
+	services = fetch()
+	assert.Len(t, services, 2)
+	assert.Equal(t, map[string]int{"redis": 1, "web": 1}, fake.calls())
+
+	// A deregistered service is remembered, so that further events at the same index don't fetch it.
+	fake.set("web", nil)
+	for i := 0; i < 2; i++ {
+		svc, err := app.fetchServiceMeta(ctx, src, "default", "web", fake.index)
+		require.NoError(t, err)
+		assert.Nil(t, svc)
+	}
+	assert.Equal(t, map[string]int{"web": 1}, fake.calls())
+	assert.Len(t, src.cachedServices(), 1)
+}
+
+func TestFetchSourceServicesJobCache(t *testing.T) {
+	fake := &fakeServices{services: make(map[string][]*api.ServiceRegistration), gets: make(map[string]int)}
+	src := newFakeSource(t, fake)
+	app := &App{
+		lo: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		opts: Opts{
+			maxConcurrentFetches: 2,
+			annotationPrefix:     DefaultAnnotationPrefix,
+			metaAnnotations:      true,
+		},
+		sources: []*nomadSource{src},
+	}
+
+	fake.set("redis", []string{"external-dns/hostname=redis.test.internal"}, "10.0.0.1")
+	fake.set("web", nil, "10.0.0.2")
+
+	services, err := app.fetchSourceServices(context.Background(), src)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1m"}, services["redis.test.internal."].Annotations[TTLAnnotationKey])
+	assert.Len(t, src.jobCache, 2)
+
+	// The jobs of purged services are dropped from the cache.
+	fake.set("web", nil)
+	_, err = app.fetchSourceServices(context.Background(), src)
+	require.NoError(t, err)
+	assert.Len(t, src.jobCache, 1)
+	assert.Contains(t, src.jobCache, serviceCacheKey("default", "redis"))
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+// Change is a change to a single record set, i.e. all the values of a name and type in a zone.
+type Change struct {
+	Zone    string
+	Proxied *bool
+	// Record is the desired record set for creates and updates, and the current one for deletes.
+	Record libdns.Record
+	// Previous is the current record set for updates.
+	Previous libdns.Record
+}
+
+// Plan holds the record sets which are to be created, updated or deleted to move the zones
+// from the current to the desired state.
+type Plan struct {
+	Creates []Change
+	Updates []Change
+	Deletes []Change
+}
+
+// recordKey identifies a record set by its fully qualified name and type.
+type recordKey struct {
+	name string
+	typ  string
+}
+
+// keyOf returns the key of a record in a zone. Names relative to the zone, with or without
+// a trailing dot, and fully qualified names are all resolved to the same key.
+func keyOf(r libdns.Record, zone string) recordKey {
+	name := r.Name
+	if !strings.HasSuffix(name, "."+zone) && name != zone {
+		name = libdns.AbsoluteName(name, zone)
+	}
+	return recordKey{name: strings.ToLower(name), typ: r.Type}
+}
+
+// zoneRecords holds the keys of all the record sets in zones as fetched from the providers, owned or not.
+type zoneRecords map[string]map[recordKey]struct{}
+
+// add adds the record sets of a zone.
+func (z zoneRecords) add(zone string, records []libdns.Record) {
+	zone = EnsureFQDN(zone)
+	if z[zone] == nil {
+		z[zone] = make(map[recordKey]struct{})
+	}
+	for _, r := range records {
+		z[zone][keyOf(r, zone)] = struct{}{}
+	}
+}
+
+// has checks if the record set of a change exists in its zone.
+func (z zoneRecords) has(c Change) bool {
+	_, ok := z[EnsureFQDN(c.Zone)][keyOf(c.Record, EnsureFQDN(c.Zone))]
+	return ok
+}
+
+// newPlan compares the desired records of the services with the current records and returns the changes
+// to be made. Record sets which only exist in the desired state are created, the ones whose values or TTL differ
+// are updated and the ones which only exist in the current state are deleted.
+// The changes are ordered by the desired state, while deletes are ordered by zone, name and type.
+func newPlan(desired, current []RecordMeta) Plan {
+	// Index the current record sets by zone and key.
+	existing := make(map[string]map[recordKey]libdns.Record)
+	for _, rm := range current {
+		zone := EnsureFQDN(rm.Zone)
+		if existing[zone] == nil {
+			existing[zone] = make(map[recordKey]libdns.Record)
+		}
+		for _, r := range rm.Records {
+			existing[zone][keyOf(r, zone)] = r
+		}
+	}
+
+	var (
+		plan = Plan{}
+		seen = make(map[string]map[recordKey]struct{})
+	)
+	for _, rm := range desired {
+		zone := EnsureFQDN(rm.Zone)
+		if seen[zone] == nil {
+			seen[zone] = make(map[recordKey]struct{})
+		}
+		for _, r := range rm.Records {
+			key := keyOf(r, zone)
+			if _, ok := seen[zone][key]; ok {
+				continue
+			}
+			seen[zone][key] = struct{}{}
+
+			cur, ok := existing[zone][key]
+			switch {
+			case !ok:
+				plan.Creates = append(plan.Creates, Change{Zone: zone, Proxied: rm.Proxied, Record: r})
+			case !sameRecord(r, cur):
+				plan.Updates = append(plan.Updates, Change{Zone: zone, Proxied: rm.Proxied, Record: r, Previous: cur})
+			}
+		}
+	}
+
+	for zone, records := range existing {
+		for key, r := range records {
+			if _, ok := seen[zone][key]; !ok {
+				plan.Deletes = append(plan.Deletes, Change{Zone: zone, Record: r})
+			}
+		}
+	}
+	sort.Slice(plan.Deletes, func(i, j int) bool {
+		a, b := plan.Deletes[i], plan.Deletes[j]
+		ka, kb := keyOf(a.Record, a.Zone), keyOf(b.Record, b.Zone)
+		if a.Zone != b.Zone {
+			return a.Zone < b.Zone
+		}
+		if ka.name != kb.name {
+			return ka.name < kb.name
+		}
+		return ka.typ < kb.typ
+	})
+
+	return plan
+}
+
+// isEmpty returns true if there are no changes to be made.
+func (p Plan) isEmpty() bool {
+	return len(p.Creates) == 0 && len(p.Updates) == 0 && len(p.Deletes) == 0
+}
+
+// splitDeletes separates the deletes which have to be applied before the creates and updates,
+// as a CNAME can't coexist with other records at the same name.
+func (p Plan) splitDeletes() (before, after []Change) {
+	upserts := append(append([]Change{}, p.Creates...), p.Updates...)
+	for _, d := range p.Deletes {
+		conflict := false
+		for _, u := range upserts {
+			if keyOf(d.Record, d.Zone).name == keyOf(u.Record, u.Zone).name && (d.Record.Type == "CNAME" || u.Record.Type == "CNAME") {
+				conflict = true
+				break
+			}
+		}
+		if conflict {
+			before = append(before, d)
+		} else {
+			after = append(after, d)
+		}
+	}
+	return before, after
+}
+
+// groupChanges groups the changes by zone and Cloudflare proxy setting, so that they can be sent
+// to the DNS provider in a single call each. The groups are ordered by their first change.
+func groupChanges(changes []Change) []RecordMeta {
+	var (
+		groups = make([]RecordMeta, 0)
+		index  = make(map[string]int)
+	)
+	for _, c := range changes {
+		key := c.Zone
+		if c.Proxied != nil {
+			key += "/" + strconv.FormatBool(*c.Proxied)
+		}
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, RecordMeta{Zone: c.Zone, Proxied: c.Proxied})
+		}
+		groups[i].Records = append(groups[i].Records, c.Record)
+	}
+	return groups
+}
+
+// sameRecord checks if the desired record set matches the current one.
+// Values are compared regardless of their order and presentation format.
+// Providers like Cloudflare report an automatic TTL of 1 second for proxied records, which isn't compared.
+func sameRecord(desired, current libdns.Record) bool {
+	if current.TTL > time.Second && desired.TTL != current.TTL {
+		return false
+	}
+	return sameStringSlice(normalizeValues(desired.Type, desired.Value), normalizeValues(current.Type, current.Value))
+}
+
+// normalizeValues splits a record value into its individual values in a canonical form,
+// as providers return values in their own presentation format.
+func normalizeValues(typ, value string) []string {
+	values := splitValues(value)
+	for i, v := range values {
+		switch typ {
+		case "TXT":
+			v = strings.Trim(v, `"`)
+		case "A", "AAAA":
+			if ip, err := netip.ParseAddr(v); err == nil {
+				if typ == "A" {
+					ip = ip.Unmap()
+				}
+				v = ip.String()
+			}
+		case "CNAME":
+			v = EnsureFQDN(strings.ToLower(v))
+		case "SRV":
+			if fields := strings.Fields(v); len(fields) == 4 {
+				fields[3] = EnsureFQDN(strings.ToLower(fields[3]))
+				v = strings.Join(fields, " ")
+			}
+		}
+		values[i] = v
+	}
+	return values
+}
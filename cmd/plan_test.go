@@ -0,0 +1,196 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPlan(t *testing.T) {
+	const (
+		zone = "test.internal."
+		ttl  = 30 * time.Second
+	)
+	proxied := func(b bool) *bool { return &b }
+	meta := func(records ...libdns.Record) []RecordMeta {
+		return []RecordMeta{{Zone: zone, Records: records}}
+	}
+
+	tests := []struct {
+		name    string
+		desired []RecordMeta
+		current []RecordMeta
+		want    Plan
+	}{
+		{
+			name:    "nothing to do",
+			desired: nil,
+			current: nil,
+			want:    Plan{},
+		},
+		{
+			name:    "create",
+			desired: meta(libdns.Record{Type: "A", Name: "redis", Value: "10.0.0.1", TTL: ttl}),
+			want: Plan{Creates: []Change{
+				{Zone: zone, Record: libdns.Record{Type: "A", Name: "redis", Value: "10.0.0.1", TTL: ttl}},
+			}},
+		},
+		{
+			name:    "create keeps the proxy setting",
+			desired: []RecordMeta{{Zone: "test.internal", Proxied: proxied(true), Records: []libdns.Record{{Type: "A", Name: "web", Value: "10.0.0.1", TTL: ttl}}}},
+			want: Plan{Creates: []Change{
+				{Zone: zone, Proxied: proxied(true), Record: libdns.Record{Type: "A", Name: "web", Value: "10.0.0.1", TTL: ttl}},
+			}},
+		},
+		{
+			name:    "unchanged",
+			desired: meta(libdns.Record{Type: "A", Name: "redis", Value: "10.0.0.1,10.0.0.2", TTL: ttl}),
+			current: meta(libdns.Record{Type: "A", Name: "redis", Value: "10.0.0.2,10.0.0.1", TTL: ttl}),
+			want:    Plan{},
+		},
+		{
+			name:    "update value",
+			desired: meta(libdns.Record{Type: "A", Name: "redis", Value: "10.0.0.1,10.0.0.3", TTL: ttl}),
+			current: meta(libdns.Record{Type: "A", Name: "redis", Value: "10.0.0.1,10.0.0.2", TTL: ttl}),
+			want: Plan{Updates: []Change{{
+				Zone:     zone,
+				Record:   libdns.Record{Type: "A", Name: "redis", Value: "10.0.0.1,10.0.0.3", TTL: ttl},
+				Previous: libdns.Record{Type: "A", Name: "redis", Value: "10.0.0.1,10.0.0.2", TTL: ttl},
+			}}},
+		},
+		{
+			name:    "update ttl",
+			desired: meta(libdns.Record{Type: "A", Name: "redis", Value: "10.0.0.1", TTL: time.Minute}),
+			current: meta(libdns.Record{Type: "A", Name: "redis", Value: "10.0.0.1", TTL: ttl}),
+			want: Plan{Updates: []Change{{
+				Zone:     zone,
+				Record:   libdns.Record{Type: "A", Name: "redis", Value: "10.0.0.1", TTL: time.Minute},
+				Previous: libdns.Record{Type: "A", Name: "redis", Value: "10.0.0.1", TTL: ttl},
+			}}},
+		},
+		{
+			name:    "automatic ttl isn't compared",
+			desired: meta(libdns.Record{Type: "A", Name: "web", Value: "10.0.0.1", TTL: ttl}),
+			current: meta(libdns.Record{Type: "A", Name: "web", Value: "10.0.0.1", TTL: time.Second}),
+			want:    Plan{},
+		},
+		{
+			name: "provider presentation format",
+			desired: meta(
+				libdns.Record{Type: "A", Name: "redis", Value: "192.168.1.2", TTL: ttl},
+				libdns.Record{Type: "AAAA", Name: "redis", Value: "2001:db8::1", TTL: ttl},
+				libdns.Record{Type: "TXT", Name: "redis", Value: "service=redis owner=test-owner", TTL: ttl},
+				libdns.Record{Type: "CNAME", Name: "api", Value: "lb.example.com.", TTL: ttl},
+				libdns.Record{Type: "SRV", Name: "_redis._tcp.redis", Value: "10 10 6379 0b5a3c1e.redis.test.internal.", TTL: ttl},
+			),
+			current: meta(
+				libdns.Record{Type: "A", Name: "redis.", Value: "::ffff:192.168.1.2", TTL: ttl},
+				libdns.Record{Type: "AAAA", Name: "redis.test.internal.", Value: "2001:0db8:0000::0001", TTL: ttl},
+				libdns.Record{Type: "TXT", Name: "redis.", Value: `"service=redis owner=test-owner"`, TTL: ttl},
+				libdns.Record{Type: "CNAME", Name: "API.test.internal.", Value: "LB.example.com", TTL: ttl},
+				libdns.Record{Type: "SRV", Name: "_redis._tcp.redis.", Value: "10 10 6379 0b5a3c1e.redis.test.internal", TTL: ttl},
+			),
+			want: Plan{},
+		},
+		{
+			name:    "delete",
+			desired: meta(libdns.Record{Type: "A", Name: "redis", Value: "10.0.0.1", TTL: ttl}),
+			current: meta(
+				libdns.Record{Type: "TXT", Name: "web.", Value: "service=web", TTL: ttl},
+				libdns.Record{Type: "A", Name: "web.", Value: "10.0.0.2", TTL: ttl},
+				libdns.Record{Type: "A", Name: "redis.", Value: "10.0.0.1", TTL: ttl},
+			),
+			want: Plan{Deletes: []Change{
+				{Zone: zone, Record: libdns.Record{Type: "A", Name: "web.", Value: "10.0.0.2", TTL: ttl}},
+				{Zone: zone, Record: libdns.Record{Type: "TXT", Name: "web.", Value: "service=web", TTL: ttl}},
+			}},
+		},
+		{
+			name:    "record type changes",
+			desired: meta(libdns.Record{Type: "AAAA", Name: "redis", Value: "2001:db8::1", TTL: ttl}),
+			current: meta(libdns.Record{Type: "A", Name: "redis.", Value: "10.0.0.1", TTL: ttl}),
+			want: Plan{
+				Creates: []Change{{Zone: zone, Record: libdns.Record{Type: "AAAA", Name: "redis", Value: "2001:db8::1", TTL: ttl}}},
+				Deletes: []Change{{Zone: zone, Record: libdns.Record{Type: "A", Name: "redis.", Value: "10.0.0.1", TTL: ttl}}},
+			},
+		},
+		{
+			name: "same name in different zones",
+			desired: []RecordMeta{
+				{Zone: "example.com.", Records: []libdns.Record{{Type: "A", Name: "web", Value: "10.0.0.1", TTL: ttl}}},
+			},
+			current: meta(libdns.Record{Type: "A", Name: "web.", Value: "10.0.0.1", TTL: ttl}),
+			want: Plan{
+				Creates: []Change{{Zone: "example.com.", Record: libdns.Record{Type: "A", Name: "web", Value: "10.0.0.1", TTL: ttl}}},
+				Deletes: []Change{{Zone: zone, Record: libdns.Record{Type: "A", Name: "web.", Value: "10.0.0.1", TTL: ttl}}},
+			},
+		},
+		{
+			name: "duplicate record sets in the desired state",
+			desired: meta(
+				libdns.Record{Type: "A", Name: "web", Value: "10.0.0.1", TTL: ttl},
+				libdns.Record{Type: "A", Name: "web", Value: "10.0.0.2", TTL: ttl},
+			),
+			want: Plan{Creates: []Change{
+				{Zone: zone, Record: libdns.Record{Type: "A", Name: "web", Value: "10.0.0.1", TTL: ttl}},
+			}},
+		},
+		{
+			name:    "zone apex",
+			desired: meta(libdns.Record{Type: "A", Name: "", Value: "10.0.0.1", TTL: ttl}),
+			current: meta(libdns.Record{Type: "A", Name: zone, Value: "10.0.0.1", TTL: ttl}),
+			want:    Plan{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newPlan(tt.desired, tt.current)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.want.isEmpty(), got.isEmpty())
+		})
+	}
+}
+
+func TestPlanSplitDeletes(t *testing.T) {
+	const zone = "test.internal."
+	plan := Plan{
+		Creates: []Change{
+			{Zone: zone, Record: libdns.Record{Type: "CNAME", Name: "api", Value: "lb.example.com."}},
+			{Zone: zone, Record: libdns.Record{Type: "A", Name: "web", Value: "10.0.0.1"}},
+		},
+		Deletes: []Change{
+			// The A record of a service which moves to a CNAME has to be deleted before the CNAME is created.
+			{Zone: zone, Record: libdns.Record{Type: "A", Name: "api.", Value: "10.0.0.2"}},
+			// The CNAME of a service which moves to its addresses has to be deleted before the A record is created.
+			{Zone: zone, Record: libdns.Record{Type: "CNAME", Name: "web.test.internal.", Value: "lb.example.com."}},
+			{Zone: zone, Record: libdns.Record{Type: "AAAA", Name: "web.", Value: "2001:db8::1"}},
+			{Zone: zone, Record: libdns.Record{Type: "A", Name: "gone.", Value: "10.0.0.3"}},
+		},
+	}
+
+	before, after := plan.splitDeletes()
+	assert.Equal(t, plan.Deletes[:2], before)
+	assert.Equal(t, plan.Deletes[2:], after)
+}
+
+func TestGroupChanges(t *testing.T) {
+	proxied := true
+	changes := []Change{
+		{Zone: "test.internal.", Record: libdns.Record{Type: "A", Name: "redis", Value: "10.0.0.1"}},
+		{Zone: "example.com.", Record: libdns.Record{Type: "A", Name: "web", Value: "10.0.0.2"}},
+		{Zone: "test.internal.", Proxied: &proxied, Record: libdns.Record{Type: "A", Name: "api", Value: "10.0.0.3"}},
+		{Zone: "test.internal.", Record: libdns.Record{Type: "TXT", Name: "redis", Value: "service=redis"}},
+	}
+
+	assert.Equal(t, []RecordMeta{
+		{Zone: "test.internal.", Records: []libdns.Record{
+			{Type: "A", Name: "redis", Value: "10.0.0.1"},
+			{Type: "TXT", Name: "redis", Value: "service=redis"},
+		}},
+		{Zone: "example.com.", Records: []libdns.Record{{Type: "A", Name: "web", Value: "10.0.0.2"}}},
+		{Zone: "test.internal.", Proxied: &proxied, Records: []libdns.Record{{Type: "A", Name: "api", Value: "10.0.0.3"}}},
+	}, groupChanges(changes))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/libdns/libdns"
+)
+
+// syncPolicy restricts the kind of changes which are made to the DNS records.
+type syncPolicy string
+
+const (
+	// policySync creates, updates and deletes records to match the services.
+	policySync syncPolicy = "sync"
+	// policyUpsertOnly creates and updates records, but never deletes them.
+	policyUpsertOnly syncPolicy = "upsert-only"
+	// policyCreateOnly only creates records, and never modifies or deletes existing ones.
+	policyCreateOnly syncPolicy = "create-only"
+)
+
+// parsePolicy parses the `dns.policy` setting. It defaults to policySync if unset.
+func parsePolicy(value string) (syncPolicy, error) {
+	switch p := syncPolicy(strings.ToLower(strings.TrimSpace(value))); p {
+	case "":
+		return policySync, nil
+	case policySync, policyUpsertOnly, policyCreateOnly:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown policy %q, should be one of %s, %s or %s", value, policySync, policyUpsertOnly, policyCreateOnly)
+	}
+}
+
+// apply drops the changes of the plan which aren't allowed by the policy.
+// Creates of record sets which exist already, but aren't owned, would overwrite them, so the create-only policy
+// drops them along with the updates. The ownership records at their names aren't created either,
+// so that the existing records aren't claimed.
+func (p syncPolicy) apply(plan Plan, existing zoneRecords) Plan {
+	switch p {
+	case policyUpsertOnly:
+		plan.Deletes = nil
+	case policyCreateOnly:
+		refused := make(map[string]struct{})
+		for _, c := range plan.Creates {
+			if existing.has(c) {
+				name := keyOf(c.Record, c.Zone).name
+				refused[name] = struct{}{}
+				refused[ownershipName(name)] = struct{}{}
+			}
+		}
+		creates := make([]Change, 0, len(plan.Creates))
+		for _, c := range plan.Creates {
+			if _, ok := refused[keyOf(c.Record, c.Zone).name]; !ok {
+				creates = append(creates, c)
+			}
+		}
+		plan.Creates = creates
+		plan.Updates = nil
+		plan.Deletes = nil
+	}
+	return plan
+}
+
+// plan compares the desired with the current records and returns the changes allowed by the configured policy.
+// `existing` holds all the record sets in the zones of the records, owned or not.
+// All the changes sent to the DNS providers, or logged in dry run mode, are planned here.
+func (app *App) plan(desired, current []RecordMeta, existing zoneRecords) Plan {
+	plan := newPlan(app.limitTTLs(desired), current)
+	allowed := app.opts.policy.apply(plan, existing)
+	var (
+		creates = len(plan.Creates) - len(allowed.Creates)
+		updates = len(plan.Updates) - len(allowed.Updates)
+		deletes = len(plan.Deletes) - len(allowed.Deletes)
+	)
+	if creates+updates+deletes > 0 {
+		app.lo.Debug("Skipped changes not allowed by the policy", "policy", app.opts.policy, "creates", creates, "updates", updates, "deletes", deletes)
+	}
+	return allowed
+}
+
+// limitTTLs returns the records with the TTLs raised to the minimum of the providers of their zones, if any.
+func (app *App) limitTTLs(records []RecordMeta) []RecordMeta {
+	limited := make([]RecordMeta, 0, len(records))
+	for _, rm := range records {
+		p, err := app.providerForZone(rm.Zone)
+		if l, ok := p.provider.(ttlLimiter); err == nil && ok {
+			recs := make([]libdns.Record, 0, len(rm.Records))
+			for _, r := range rm.Records {
+				if r.TTL < l.minTTL() {
+					r.TTL = l.minTTL()
+				}
+				recs = append(recs, r)
+			}
+			rm.Records = recs
+		}
+		limited = append(limited, rm)
+	}
+	return limited
+}
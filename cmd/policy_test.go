@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/libdns/libdns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePolicy(t *testing.T) {
+	for value, want := range map[string]syncPolicy{
+		"":            policySync,
+		"sync":        policySync,
+		"upsert-only": policyUpsertOnly,
+		"Create-Only": policyCreateOnly,
+	} {
+		got, err := parsePolicy(value)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got, value)
+	}
+
+	_, err := parsePolicy("delete-only")
+	assert.Error(t, err)
+}
+
+func TestPolicyApply(t *testing.T) {
+	plan := Plan{
+		Creates: []Change{
+			{Zone: "test.internal.", Record: libdns.Record{Type: "A", Name: "web", Value: "10.0.0.1"}},
+			{Zone: "test.internal.", Record: libdns.Record{Type: "TXT", Name: "web", Value: "owner=test-owner"}},
+			{Zone: "test.internal.", Record: libdns.Record{Type: "A", Name: "new", Value: "10.0.0.4"}},
+		},
+		Updates: []Change{{Zone: "test.internal.", Record: libdns.Record{Type: "A", Name: "api", Value: "10.0.0.2"}}},
+		Deletes: []Change{{Zone: "test.internal.", Record: libdns.Record{Type: "A", Name: "gone.", Value: "10.0.0.3"}}},
+	}
+
+	// The A record set of `web` exists already, but isn't owned, so neither it nor its ownership record are created.
+	existing := make(zoneRecords)
+	existing.add("test.internal.", []libdns.Record{{Type: "A", Name: "web.test.internal.", Value: "10.0.0.9"}})
+
+	tests := []struct {
+		policy   syncPolicy
+		existing zoneRecords
+		want     Plan
+	}{
+		{policySync, nil, plan},
+		{policySync, existing, plan},
+		{policyUpsertOnly, nil, Plan{Creates: plan.Creates, Updates: plan.Updates}},
+		{policyCreateOnly, nil, Plan{Creates: plan.Creates}},
+		{policyCreateOnly, existing, Plan{Creates: plan.Creates[2:]}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.policy.apply(plan, tt.existing))
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+const (
+	// defaultPowerDNSServerID is the server ID of a standalone PowerDNS Authoritative server.
+	defaultPowerDNSServerID = "localhost"
+
+	pdnsChangeReplace = "REPLACE"
+	pdnsChangeDelete  = "DELETE"
+)
+
+// powerDNSOpts represents the configuration for the PowerDNS provider.
+type powerDNSOpts struct {
+	BaseURL  string
+	APIKey   string
+	ServerID string
+	Timeout  time.Duration
+}
+
+// PowerDNSProvider implements the DNSProvider interface for the PowerDNS Authoritative HTTP API.
+// Multiple values of a record are passed as a comma separated `Value` and
+// the whole RRset is replaced atomically with a single PATCH request.
+type PowerDNSProvider struct {
+	opts   powerDNSOpts
+	client *http.Client
+}
+
+type pdnsZone struct {
+	Name   string      `json:"name"`
+	RRsets []pdnsRRset `json:"rrsets"`
+}
+
+type pdnsRRset struct {
+	Name       string       `json:"name"`
+	Type       string       `json:"type"`
+	TTL        int          `json:"ttl,omitempty"`
+	ChangeType string       `json:"changetype,omitempty"`
+	Records    []pdnsRecord `json:"records"`
+}
+
+type pdnsRecord struct {
+	Content  string `json:"content"`
+	Disabled bool   `json:"disabled"`
+}
+
+// NewPowerDNSProvider initialises a PowerDNS provider.
+func NewPowerDNSProvider(opts powerDNSOpts) (*PowerDNSProvider, error) {
+	if opts.BaseURL == "" {
+		return nil, fmt.Errorf("powerdns api_url is required")
+	}
+	if opts.APIKey == "" {
+		return nil, fmt.Errorf("powerdns api_key is required")
+	}
+	if opts.ServerID == "" {
+		opts.ServerID = defaultPowerDNSServerID
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Second * 30
+	}
+	opts.BaseURL = strings.TrimSuffix(opts.BaseURL, "/")
+
+	return &PowerDNSProvider{
+		opts:   opts,
+		client: &http.Client{Timeout: opts.Timeout},
+	}, nil
+}
+
+// GetRecords lists all the records in the zone. Record names are returned as FQDNs.
+func (p *PowerDNSProvider) GetRecords(ctx context.Context, zone string) ([]libdns.Record, error) {
+	z, err := p.getZone(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []libdns.Record
+	for _, rrset := range z.RRsets {
+		for _, r := range rrset.Records {
+			if r.Disabled {
+				continue
+			}
+			records = append(records, libdns.Record{
+				Type:  rrset.Type,
+				Name:  rrset.Name,
+				Value: r.Content,
+				TTL:   time.Duration(rrset.TTL) * time.Second,
+			})
+		}
+	}
+	return records, nil
+}
+
+// AppendRecords adds the values of the records to their existing RRsets. It returns the records that were added.
+func (p *PowerDNSProvider) AppendRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
+	z, err := p.getZone(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	rrsets := make([]pdnsRRset, 0, len(records))
+	for _, record := range records {
+		rrset := p.toRRset(record, zone)
+		if existing := findRRset(z.RRsets, rrset.Name, rrset.Type); existing != nil {
+			for _, r := range existing.Records {
+				if !containsContent(rrset.Records, r.Content) {
+					rrset.Records = append(rrset.Records, r)
+				}
+			}
+		}
+		rrsets = append(rrsets, rrset)
+	}
+
+	if err := p.patchZone(ctx, zone, rrsets); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// SetRecords replaces the RRsets of the given records in the zone. It returns the records that were set.
+func (p *PowerDNSProvider) SetRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
+	rrsets := make([]pdnsRRset, 0, len(records))
+	for _, record := range records {
+		rrsets = append(rrsets, p.toRRset(record, zone))
+	}
+
+	if err := p.patchZone(ctx, zone, rrsets); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// DeleteRecords removes the values of the records from their RRsets. If a record has no value
+// or all of the values of an RRset are removed, the RRset is deleted. It returns the records that were deleted.
+func (p *PowerDNSProvider) DeleteRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
+	z, err := p.getZone(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	rrsets := make([]pdnsRRset, 0, len(records))
+	for _, record := range records {
+		rrset := p.toRRset(record, zone)
+		existing := findRRset(z.RRsets, rrset.Name, rrset.Type)
+		if existing == nil {
+			continue
+		}
+
+		remaining := make([]pdnsRecord, 0, len(existing.Records))
+		if record.Value != "" {
+			for _, r := range existing.Records {
+				if !containsContent(rrset.Records, r.Content) {
+					remaining = append(remaining, r)
+				}
+			}
+		}
+
+		if len(remaining) == 0 {
+			rrsets = append(rrsets, pdnsRRset{Name: rrset.Name, Type: rrset.Type, ChangeType: pdnsChangeDelete, Records: []pdnsRecord{}})
+		} else {
+			rrsets = append(rrsets, pdnsRRset{Name: rrset.Name, Type: rrset.Type, TTL: existing.TTL, ChangeType: pdnsChangeReplace, Records: remaining})
+		}
+	}
+
+	if len(rrsets) == 0 {
+		return nil, nil
+	}
+	if err := p.patchZone(ctx, zone, rrsets); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// getZone fetches a zone along with all of its RRsets.
+func (p *PowerDNSProvider) getZone(ctx context.Context, zone string) (*pdnsZone, error) {
+	var z pdnsZone
+	if err := p.do(ctx, http.MethodGet, p.zonePath(zone), nil, &z); err != nil {
+		return nil, fmt.Errorf("error fetching zone %s: %w", zone, err)
+	}
+	return &z, nil
+}
+
+// patchZone applies the RRset changes to a zone in a single request.
+func (p *PowerDNSProvider) patchZone(ctx context.Context, zone string, rrsets []pdnsRRset) error {
+	if err := p.do(ctx, http.MethodPatch, p.zonePath(zone), pdnsZone{RRsets: rrsets}, nil); err != nil {
+		return fmt.Errorf("error updating zone %s: %w", zone, err)
+	}
+	return nil
+}
+
+func (p *PowerDNSProvider) zonePath(zone string) string {
+	return fmt.Sprintf("/api/v1/servers/%s/zones/%s", url.PathEscape(p.opts.ServerID), url.PathEscape(EnsureFQDN(zone)))
+}
+
+// toRRset converts a libdns record into an RRset which replaces the existing one.
+func (p *PowerDNSProvider) toRRset(record libdns.Record, zone string) pdnsRRset {
+	rrset := pdnsRRset{
+		Name:       libdns.AbsoluteName(record.Name, EnsureFQDN(zone)),
+		Type:       record.Type,
+		TTL:        int(record.TTL.Seconds()),
+		ChangeType: pdnsChangeReplace,
+		Records:    []pdnsRecord{},
+	}
+	for _, value := range splitValues(record.Value) {
+		// PowerDNS expects the content in presentation format, which requires TXT values to be quoted.
+		if record.Type == "TXT" && !strings.HasPrefix(value, `"`) {
+			value = strconv.Quote(value)
+		}
+		rrset.Records = append(rrset.Records, pdnsRecord{Content: value})
+	}
+	return rrset
+}
+
+// findRRset returns the RRset matching the name and type, if present.
+func findRRset(rrsets []pdnsRRset, name, typ string) *pdnsRRset {
+	for i := range rrsets {
+		if rrsets[i].Name == name && rrsets[i].Type == typ {
+			return &rrsets[i]
+		}
+	}
+	return nil
+}
+
+// containsContent checks if a record with the given content is present.
+func containsContent(records []pdnsRecord, content string) bool {
+	for _, r := range records {
+		if r.Content == content {
+			return true
+		}
+	}
+	return false
+}
+
+// do sends a request to the PowerDNS API and decodes the response into `out`.
+func (p *PowerDNSProvider) do(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.opts.BaseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-Key", p.opts.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return fmt.Errorf("powerdns api error (status %d)", resp.StatusCode)
+		}
+		return fmt.Errorf("powerdns api error (status %d): %s", resp.StatusCode, e.Error)
+	}
+
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("error decoding response: %w", err)
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ DNSProvider = (*PowerDNSProvider)(nil)
+)
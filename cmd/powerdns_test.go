@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePowerDNS is an in-memory stand-in for the PowerDNS Authoritative zones API.
+type fakePowerDNS struct {
+	sync.Mutex
+	zone    pdnsZone
+	patches [][]pdnsRRset
+}
+
+func (f *fakePowerDNS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if r.Header.Get("X-API-Key") != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+		return
+	}
+
+	if r.URL.Path != "/api/v1/servers/localhost/zones/"+f.zone.Name {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "Could not find domain"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		_ = json.NewEncoder(w).Encode(f.zone)
+
+	case http.MethodPatch:
+		var z pdnsZone
+		if err := json.NewDecoder(r.Body).Decode(&z); err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		f.patches = append(f.patches, z.RRsets)
+
+		for _, change := range z.RRsets {
+			kept := make([]pdnsRRset, 0, len(f.zone.RRsets))
+			for _, rrset := range f.zone.RRsets {
+				if rrset.Name != change.Name || rrset.Type != change.Type {
+					kept = append(kept, rrset)
+				}
+			}
+			if change.ChangeType == pdnsChangeReplace {
+				change.ChangeType = ""
+				kept = append(kept, change)
+			}
+			f.zone.RRsets = kept
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func newTestPowerDNS(t *testing.T) (*PowerDNSProvider, *fakePowerDNS) {
+	fake := &fakePowerDNS{zone: pdnsZone{Name: "test.internal.", RRsets: []pdnsRRset{}}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	p, err := NewPowerDNSProvider(powerDNSOpts{BaseURL: srv.URL + "/", APIKey: "secret"})
+	require.NoError(t, err)
+	return p, fake
+}
+
+func TestPowerDNSSetRecords(t *testing.T) {
+	p, fake := newTestPowerDNS(t)
+	ctx := context.Background()
+
+	_, err := p.SetRecords(ctx, "test.internal.", []libdns.Record{
+		{Type: "A", Name: "redis", Value: "10.0.0.1,10.0.0.2", TTL: 30 * time.Second},
+		{Type: "TXT", Name: "redis", Value: "owner=test", TTL: 30 * time.Second},
+	})
+	require.NoError(t, err)
+
+	// Both RRsets are replaced in a single request, with all addresses in one RRset.
+	require.Len(t, fake.patches, 1)
+	assert.Equal(t, []pdnsRRset{
+		{Name: "redis.test.internal.", Type: "A", TTL: 30, ChangeType: pdnsChangeReplace, Records: []pdnsRecord{{Content: "10.0.0.1"}, {Content: "10.0.0.2"}}},
+		{Name: "redis.test.internal.", Type: "TXT", TTL: 30, ChangeType: pdnsChangeReplace, Records: []pdnsRecord{{Content: `"owner=test"`}}},
+	}, fake.patches[0])
+
+	_, err = p.SetRecords(ctx, "test.internal.", []libdns.Record{
+		{Type: "A", Name: "redis", Value: "10.0.0.3", TTL: 60 * time.Second},
+	})
+	require.NoError(t, err)
+
+	records, err := p.GetRecords(ctx, "test.internal.")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []libdns.Record{
+		{Type: "TXT", Name: "redis.test.internal.", Value: `"owner=test"`, TTL: 30 * time.Second},
+		{Type: "A", Name: "redis.test.internal.", Value: "10.0.0.3", TTL: 60 * time.Second},
+	}, records)
+}
+
+func TestPowerDNSAppendAndDeleteRecords(t *testing.T) {
+	p, fake := newTestPowerDNS(t)
+	ctx := context.Background()
+
+	_, err := p.AppendRecords(ctx, "test.internal.", []libdns.Record{
+		{Type: "A", Name: "redis", Value: "10.0.0.1", TTL: 30 * time.Second},
+	})
+	require.NoError(t, err)
+	_, err = p.AppendRecords(ctx, "test.internal.", []libdns.Record{
+		{Type: "A", Name: "redis", Value: "10.0.0.2", TTL: 30 * time.Second},
+		{Type: "TXT", Name: "redis", Value: "owner=test", TTL: 30 * time.Second},
+	})
+	require.NoError(t, err)
+
+	records, err := p.GetRecords(ctx, "test.internal.")
+	require.NoError(t, err)
+	assert.Len(t, records, 3)
+
+	// Removing a single value keeps the rest of the RRset. Names relative to the zone,
+	// as produced by the pruner, must be resolved.
+	_, err = p.DeleteRecords(ctx, "test.internal.", []libdns.Record{
+		{Type: "A", Name: "redis.", Value: "10.0.0.1"},
+		{Type: "TXT", Name: "redis.", Value: `"owner=test"`},
+	})
+	require.NoError(t, err)
+
+	records, err = p.GetRecords(ctx, "test.internal.")
+	require.NoError(t, err)
+	assert.Equal(t, []libdns.Record{
+		{Type: "A", Name: "redis.test.internal.", Value: "10.0.0.2", TTL: 30 * time.Second},
+	}, records)
+	assert.Equal(t, pdnsChangeDelete, fake.patches[len(fake.patches)-1][1].ChangeType)
+}
+
+func TestPowerDNSErrors(t *testing.T) {
+	p, _ := newTestPowerDNS(t)
+
+	_, err := p.GetRecords(context.Background(), "unknown.internal.")
+	assert.ErrorContains(t, err, "Could not find domain")
+
+	p.opts.APIKey = "invalid"
+	_, err = p.SetRecords(context.Background(), "test.internal.", []libdns.Record{{Type: "A", Name: "redis", Value: "10.0.0.1"}})
+	assert.ErrorContains(t, err, "Unauthorized")
+
+	_, err = NewPowerDNSProvider(powerDNSOpts{BaseURL: "http://localhost:8081"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// probeState tracks the state of the workers and of the calls to Nomad and the DNS providers,
+// to report the health and readiness of the app.
+type probeState struct {
+	mu sync.Mutex
+
+	// staleness is the window within which a worker has to complete a run, and Nomad and a DNS provider
+	// have to be called successfully.
+	staleness time.Duration
+	workers   map[string]*workerState
+
+	lastNomadFetch   time.Time
+	lastProviderCall time.Time
+
+	// standby is set while another instance is the leader, and this instance doesn't run the workers.
+	standby bool
+}
+
+// workerState is the state of a periodic worker.
+type workerState struct {
+	interval time.Duration
+	running  bool
+	// lastRun is when the worker last completed a run, or when it was started.
+	lastRun time.Time
+}
+
+// workerStarted marks a worker as running.
+func (p *probeState) workerStarted(name string, interval time.Duration, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.workers == nil {
+		p.workers = make(map[string]*workerState)
+	}
+	p.workers[name] = &workerState{interval: interval, running: true, lastRun: now}
+}
+
+// workerRan records a completed run of a worker.
+func (p *probeState) workerRan(name string, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if w, ok := p.workers[name]; ok {
+		w.lastRun = now
+	}
+}
+
+// workerStopped marks a worker as no longer running.
+func (p *probeState) workerStopped(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if w, ok := p.workers[name]; ok {
+		w.running = false
+	}
+}
+
+// setStandby marks the instance as a follower which doesn't run the workers, or as the leader.
+// The workers of a previous leadership are forgotten.
+func (p *probeState) setStandby(standby bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.standby = standby
+	if standby {
+		p.workers = nil
+	}
+}
+
+// nomadFetched records a successful call to Nomad, i.e. a fetch of services or an attempt to acquire the leader lock.
+func (p *probeState) nomadFetched(now time.Time) {
+	p.mu.Lock()
+	p.lastNomadFetch = now
+	p.mu.Unlock()
+}
+
+// providerCalled records a successful call to a DNS provider.
+func (p *probeState) providerCalled(now time.Time) {
+	p.mu.Lock()
+	p.lastProviderCall = now
+	p.mu.Unlock()
+}
+
+// healthy returns an error if a worker has stopped, or hasn't completed a run within the staleness window
+// or twice its interval, whichever is longer. A follower is healthy as long as it tries to acquire the leader lock.
+func (p *probeState) healthy(now time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.standby {
+		return nil
+	}
+	if len(p.workers) == 0 {
+		return fmt.Errorf("workers aren't started")
+	}
+
+	names := make([]string, 0, len(p.workers))
+	for name := range p.workers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		w := p.workers[name]
+		if !w.running {
+			return fmt.Errorf("worker %s isn't running", name)
+		}
+		window := p.staleness
+		if 2*w.interval > window {
+			window = 2 * w.interval
+		}
+		if since := now.Sub(w.lastRun); since > window {
+			return fmt.Errorf("worker %s hasn't completed a run in %s", name, since.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// ready returns an error if services haven't been fetched from Nomad, or a DNS provider hasn't been called
+// successfully within the staleness window. A follower only has to reach Nomad.
+func (p *probeState) ready(now time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.lastNomadFetch.IsZero() || now.Sub(p.lastNomadFetch) > p.staleness {
+		return fmt.Errorf("no successful call to Nomad within %s", p.staleness)
+	}
+	if p.standby {
+		return nil
+	}
+	if p.lastProviderCall.IsZero() || now.Sub(p.lastProviderCall) > p.staleness {
+		return fmt.Errorf("no successful call to a DNS provider within %s", p.staleness)
+	}
+	return nil
+}
+
+// handleHealthz reports whether the process is alive and its workers are running.
+func (app *App) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeProbe(w, app.probes.healthy(time.Now()))
+}
+
+// handleReadyz reports whether Nomad and the DNS providers have been reached within the staleness window.
+func (app *App) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	writeProbe(w, app.probes.ready(time.Now()))
+}
+
+// writeProbe writes the result of a probe, with a 503 status and the reason if it failed.
+func writeProbe(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// observeProviderCall records a call to a DNS provider in the metrics, and for the readiness probe if it succeeded.
+func (app *App) observeProviderCall(provider, operation, zone string, start time.Time, err error) {
+	observeProviderCall(provider, operation, zone, start, err)
+	if err == nil {
+		app.probes.providerCalled(time.Now())
+	}
+}
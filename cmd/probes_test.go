@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeStateHealthy(t *testing.T) {
+	now := time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)
+	p := &probeState{staleness: time.Minute}
+
+	assert.Error(t, p.healthy(now), "workers aren't started")
+
+	p.workerStarted("updater", 10*time.Second, now)
+	p.workerStarted("pruner", 5*time.Minute, now)
+	assert.NoError(t, p.healthy(now.Add(time.Minute)))
+
+	// The updater is wedged, while the pruner is within twice its interval.
+	assert.Error(t, p.healthy(now.Add(2*time.Minute)))
+	p.workerRan("updater", now.Add(2*time.Minute))
+	assert.NoError(t, p.healthy(now.Add(2*time.Minute)))
+	assert.Error(t, p.healthy(now.Add(11*time.Minute)))
+
+	p.workerRan("pruner", now.Add(2*time.Minute))
+	p.workerStopped("pruner")
+	assert.Error(t, p.healthy(now.Add(2*time.Minute)))
+}
+
+func TestProbeStateReady(t *testing.T) {
+	now := time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)
+	p := &probeState{staleness: time.Minute}
+
+	assert.Error(t, p.ready(now))
+
+	p.nomadFetched(now)
+	assert.Error(t, p.ready(now), "no provider call yet")
+
+	p.providerCalled(now)
+	assert.NoError(t, p.ready(now.Add(time.Minute)))
+
+	p.nomadFetched(now.Add(2 * time.Minute))
+	assert.Error(t, p.ready(now.Add(2*time.Minute)), "provider call is stale")
+}
+
+func TestHandleProbes(t *testing.T) {
+	app := &App{probes: probeState{staleness: time.Minute}}
+
+	rec := httptest.NewRecorder()
+	app.handleReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	app.probes.nomadFetched(time.Now())
+	app.probes.providerCalled(time.Now())
+	app.probes.workerStarted("updater", time.Second, time.Now())
+
+	rec = httptest.NewRecorder()
+	app.handleReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "ok\n", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	app.handleHealthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
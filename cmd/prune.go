@@ -3,97 +3,243 @@ package main
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/libdns/libdns"
 )
 
-// cleanupRecords identifies outdated DNS records and deletes them from the DNS provider.
-// This method is locked to prevent concurrent modification of shared resources.
-func (app *App) cleanupRecords() error {
-	app.Lock()         // Lock to prevent concurrent modifications
-	defer app.Unlock() // Unlock when function execution is finished
+// cleanupRecords identifies outdated DNS records and deletes them from the DNS providers.
+// Each provider is pruned independently so that a failing provider doesn't block the others.
+func (app *App) cleanupRecords(ctx context.Context) error {
+	failed := make([]string, 0)
+	for _, p := range app.providers {
+		if err := app.cleanupProviderRecords(ctx, p); err != nil {
+			app.lo.Error("Failed to cleanup records", "provider", p.name, "error", err)
+			failed = append(failed, p.name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("error cleaning up records for providers: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// cleanupProviderRecords reconciles the DNS records in the zones of a single provider with the services.
+// The owned records are fetched from the provider and compared against the records of the services, so that
+// records of services which are gone are deleted and records which drifted from the services are repaired.
+// The zones of the provider are locked meanwhile, so that the records of a service synced concurrently aren't deleted.
+func (app *App) cleanupProviderRecords(ctx context.Context, p providerInstance) error {
+	app.lo.Info("Starting cleanup of DNS records", "provider", p.name)
+
+	unlock := app.zones.lock(p.domains)
+	defer unlock()
 
-	app.lo.Info("Starting cleanup of DNS records")
+	plan, err := app.planProvider(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	if app.opts.dryRun {
+		app.logDryRun(plan)
+		return nil
+	}
 
+	return app.applyProviderPlan(ctx, plan)
+}
+
+// planProvider fetches the owned records in the zones of a provider and plans the changes to match the services.
+// Deletions are held back by the deletion guard.
+func (app *App) planProvider(ctx context.Context, p providerInstance) (Plan, error) {
 	// Fetch all DNS records owned by this program
-	recordsMap, err := app.fetchRecords()
+	recordsMap, existing, err := app.fetchRecords(ctx, p, app.prunableClusters())
 	if err != nil {
-		return fmt.Errorf("error fetching records: %w", err)
+		return Plan{}, fmt.Errorf("error fetching records: %w", err)
 	}
 
-	// Identify records that are outdated i.e., not present in the current service list
-	outdatedRecords := identifyOutdatedRecords(app.services, recordsMap)
-	app.lo.Info("Identified outdated records", "count", len(outdatedRecords), "records", outdatedRecords)
+	desired, current := desiredState(app.syncedServices(), recordsMap, app.opts.domains, p.domains, app.opts.owner, app.prunableClusters())
+	plan := app.plan(desired, current, existing)
+	plan.Deletes = app.guardDeletes(p, plan.Deletes, countRecords(current))
+	app.inspect.setRecords(p.name, recordsMap)
+	app.inspect.setPrunePlan(p.name, plan, time.Now())
+	app.lo.Info("Computed plan for records", "provider", p.name,
+		"creates", len(plan.Creates), "updates", len(plan.Updates), "deletes", len(plan.Deletes))
+
+	return plan, nil
+}
 
-	// Delete the outdated records from the DNS provider.
-	if len(outdatedRecords) > 0 {
-		if err := app.deleteOutdatedRecords(outdatedRecords, recordsMap); err != nil {
-			return fmt.Errorf("error deleting outdated records: %w", err)
+// applyProviderPlan applies the plan of a provider and returns an error with the zones for which a change failed.
+func (app *App) applyProviderPlan(ctx context.Context, plan Plan) error {
+	if failed := app.applyPlan(ctx, plan); len(failed) > 0 {
+		zones := make([]string, 0, len(failed))
+		for zone := range failed {
+			zones = append(zones, zone)
 		}
+		sort.Strings(zones)
+		return fmt.Errorf("error applying changes to zones: %s", strings.Join(zones, ", "))
 	}
 
 	return nil
 }
 
-// identifyOutdatedRecords compares the current service list with the DNS records and identifies which records are outdated.
-func identifyOutdatedRecords(services map[string]ServiceMeta, recordsMap map[string][]RecordMeta) []string {
-	outdatedRecords := make([]string, 0)
-	for recordName := range recordsMap {
-		if _, exists := services[recordName]; !exists {
-			outdatedRecords = append(outdatedRecords, recordName)
+// desiredState returns the records of the services in the given zones, along with the owned records to compare them against.
+// Only the services of the given clusters are considered, as the records of the other clusters aren't fetched.
+// The records of a service which can't be converted to records (e.g. when its hostname is invalid)
+// are left as they are, instead of being deleted. The ones of a service without healthy allocations are deleted.
+func desiredState(services map[string]ServiceMeta, recordsMap map[string][]RecordMeta, domains, zones []string, owner string, clusters []string) (desired, current []RecordMeta) {
+	desired = make([]RecordMeta, 0, len(services))
+	kept := make(map[string]struct{})
+	for _, svc := range services {
+		if !Contains(clusters, svc.Cluster) {
+			continue
+		}
+
+		record, err := svc.ToRecord(domains, owner)
+		if err != nil {
+			if svc.Unhealthy {
+				continue
+			}
+			for _, name := range svc.recordNames() {
+				kept[name] = struct{}{}
+			}
+			continue
 		}
+		// Zones may be configured with or without the trailing dot.
+		if Contains(zones, record.Zone) || Contains(zones, strings.TrimSuffix(record.Zone, ".")) {
+			desired = append(desired, record)
+		}
+	}
+
+	current = make([]RecordMeta, 0, len(recordsMap))
+	for name, records := range recordsMap {
+		if _, ok := kept[name]; ok {
+			continue
+		}
+		current = append(current, records...)
 	}
-	return outdatedRecords
+
+	return desired, current
 }
 
-// fetchRecords retrieves all records from the DNS provider and filters ones that are owned by this program.
-// It groups the owned records by domain name.
-func (app *App) fetchRecords() (map[string][]RecordMeta, error) {
-	ownedRecords := make(map[string][]RecordMeta)
+// countRecords returns the number of record sets.
+func countRecords(records []RecordMeta) int {
+	count := 0
+	for _, r := range records {
+		count += len(r.Records)
+	}
+	return count
+}
+
+// fetchRecords retrieves all records in the zones of a DNS provider and filters ones that are owned by this program
+// and belong to the given clusters. It groups the owned records by domain name, and returns the keys of all the records.
+func (app *App) fetchRecords(ctx context.Context, p providerInstance, clusters []string) (map[string][]RecordMeta, zoneRecords, error) {
+	var (
+		ownedRecords = make(map[string][]RecordMeta)
+		existing     = make(zoneRecords)
+	)
 
-	// Iterate over all configured domains
-	for _, domain := range app.opts.domains {
+	// Iterate over all domains owned by the provider
+	for _, domain := range p.domains {
 		zone := EnsureFQDN(domain)
+		if err := app.fetchZoneRecords(ctx, p, zone, clusters, ownedRecords, existing); err != nil {
+			return nil, nil, err
+		}
 
-		// Get all DNS records for this zone
-		records, err := app.provider.GetRecords(context.Background(), zone)
-		if err != nil {
-			return nil, fmt.Errorf("error fetching records for zone %s: %w", zone, err)
+		managed := 0
+		for _, metas := range ownedRecords {
+			for _, m := range metas {
+				if m.Zone == zone {
+					managed++
+				}
+			}
 		}
+		setManagedRecords(p.name, zone, managed)
+	}
 
-		// Filter out records that are not owned by this program
-		recordNames := filterOwnedRecords(records, app.opts.owner)
+	return ownedRecords, existing, nil
+}
 
-		// Build a map of owned records grouped by the record name
-		// For A records, if multiple records exist for the same name, their values are concatenated
-		groupOwnedRecords(&ownedRecords, records, recordNames, zone)
+// fetchZoneRecords retrieves all records in a zone of a DNS provider, and adds the ones which are owned by this program
+// and belong to the given clusters to `ownedRecords`, grouped by domain name. The keys of all the records are added to `existing`.
+func (app *App) fetchZoneRecords(ctx context.Context, p providerInstance, zone string, clusters []string, ownedRecords map[string][]RecordMeta, existing zoneRecords) error {
+	// Get all DNS records for this zone
+	start := time.Now()
+	records, err := p.provider.GetRecords(ctx, zone)
+	app.observeProviderCall(p.name, "get", zone, start, err)
+	if err != nil {
+		return fmt.Errorf("error fetching records for zone %s: %w", zone, err)
 	}
+	existing.add(zone, records)
 
-	return ownedRecords, nil
+	// Filter out records that are not owned by this program
+	recordNames := filterOwnedRecords(records, app.opts.owner, clusters, app.sources[0].name)
+
+	// Build a map of owned records grouped by the record name
+	// For A records, if multiple records exist for the same name, their values are concatenated
+	groupOwnedRecords(&ownedRecords, records, recordNames, zone)
+	return nil
+}
+
+// clusters returns the names of all the Nomad sources.
+func (app *App) clusters() []string {
+	clusters := make([]string, 0, len(app.sources))
+	for _, src := range app.sources {
+		clusters = append(clusters, src.name)
+	}
+	return clusters
 }
 
-// filterOwnedRecords iterates over all records and returns a slice of names of records that are owned by this program.
-func filterOwnedRecords(records []libdns.Record, owner string) []string {
+// prunableClusters returns the names of the Nomad sources whose services have been fetched,
+// as only the records of those can be compared against the services of the cluster.
+func (app *App) prunableClusters() []string {
+	clusters := make([]string, 0, len(app.sources))
+	for _, src := range app.sources {
+		if src.isSynced() {
+			clusters = append(clusters, src.name)
+		}
+	}
+	return clusters
+}
+
+// filterOwnedRecords iterates over all records and returns a slice of names of records that are owned by this program
+// and belong to one of the given clusters. Records created before the cluster was recorded belong to the default cluster.
+// A TXT record at a name prefixed with OwnershipRecordPrefix marks the CNAME at the unprefixed name as owned as well.
+func filterOwnedRecords(records []libdns.Record, owner string, clusters []string, defaultCluster string) []string {
 	recordNames := make([]string, 0)
 	for _, r := range records {
-		if r.Type == "TXT" && strings.Contains(r.Value, fmt.Sprintf("owner=%s", owner)) {
+		if r.Type != "TXT" {
+			continue
+		}
+
+		fields := parseOwnershipRecord(r.Value)
+		cluster, ok := fields["cluster"]
+		if !ok {
+			cluster = defaultCluster
+		}
+		if fields["owner"] == owner && Contains(clusters, cluster) {
 			recordNames = append(recordNames, r.Name)
+			if name := strings.TrimPrefix(r.Name, OwnershipRecordPrefix+"."); name != r.Name {
+				recordNames = append(recordNames, name)
+			}
 		}
 	}
 	return recordNames
 }
 
-// groupOwnedRecords groups the owned records by their name. For A records with the same name, their values are concatenated.
+// groupOwnedRecords groups the owned records by their name. For records with the same name and type
+// (like A or SRV record sets), their values are concatenated.
 func groupOwnedRecords(ownedRecords *map[string][]RecordMeta, records []libdns.Record, recordNames []string, zone string) {
 	for _, rec := range records {
 		if Contains(recordNames, rec.Name) {
 			dns := rec.Name
 			rec.Name = strings.TrimSuffix(rec.Name, zone) // Overwrite to set a proper relative name before we delete.
 
-			// If an A record with the same name already exists, append the IP address to the existing record.
-			if rec.Type == "A" && len((*ownedRecords)[dns]) > 0 {
-				(*ownedRecords)[dns][0].Records[0].Value += "," + rec.Value
+			// Providers return every value of a record set as a separate record.
+			// If a record with the same name and type already exists, append the value to the existing record.
+			if i := indexOfType((*ownedRecords)[dns], rec.Type); i >= 0 {
+				(*ownedRecords)[dns][i].Records[0].Value += "," + rec.Value
 			} else {
 				(*ownedRecords)[dns] = append((*ownedRecords)[dns], RecordMeta{Zone: EnsureFQDN(zone), Records: []libdns.Record{rec}})
 			}
@@ -101,29 +247,12 @@ func groupOwnedRecords(ownedRecords *map[string][]RecordMeta, records []libdns.R
 	}
 }
 
-// deleteOutdatedRecords removes the outdated DNS records from the DNS provider.
-func (app *App) deleteOutdatedRecords(outdatedRecords []string, recordsMap map[string][]RecordMeta) error {
-	app.lo.Info("Starting deletion of outdated DNS records", "count", len(outdatedRecords))
-
-	// Iterate over all outdated records
-	for _, record := range outdatedRecords {
-		recordMeta, exists := recordsMap[record]
-		if !exists {
-			// This is unlikely to happen but we skip to the next iteration just in case
-			continue
-		}
-
-		// Delete each outdated record
-		for _, meta := range recordMeta {
-			_, err := app.provider.DeleteRecords(context.Background(), EnsureFQDN(meta.Zone), meta.Records)
-			if err != nil {
-				app.lo.Error("Error deleting records", "error", err)
-				continue
-			}
-
-			app.lo.Info("Deleted record successfully", "zone", meta.Zone, "records", meta.Records)
+// indexOfType returns the index of the grouped record with the given type, or -1 if there's none.
+func indexOfType(metas []RecordMeta, typ string) int {
+	for i, m := range metas {
+		if len(m.Records) > 0 && m.Records[0].Type == typ {
+			return i
 		}
 	}
-
-	return nil
+	return -1
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupOwnedRecords(t *testing.T) {
+	const (
+		owner = "test-owner"
+		txt   = `"service=redis namespace=default owner=test-owner created-by=nomad-external-dns"`
+	)
+	records := []libdns.Record{
+		{Type: "TXT", Name: "redis.test.internal.", Value: txt, TTL: 30 * time.Second},
+		{Type: "A", Name: "redis.test.internal.", Value: "10.0.0.1", TTL: 30 * time.Second},
+		{Type: "A", Name: "redis.test.internal.", Value: "10.0.0.2", TTL: 30 * time.Second},
+		{Type: "AAAA", Name: "redis.test.internal.", Value: "2001:db8::1", TTL: 30 * time.Second},
+		{Type: "SRV", Name: "_redis._tcp.redis.test.internal.", Value: "10 10 6379 0b5a3c1e.redis.test.internal.", TTL: 30 * time.Second},
+		{Type: "SRV", Name: "_redis._tcp.redis.test.internal.", Value: "10 10 6380 9f1d2e3c.redis.test.internal.", TTL: 30 * time.Second},
+		{Type: "TXT", Name: "_redis._tcp.redis.test.internal.", Value: txt, TTL: 30 * time.Second},
+		{Type: "CNAME", Name: "web.test.internal.", Value: "lb.example.com.", TTL: 30 * time.Second},
+		{Type: "TXT", Name: "_external-dns.web.test.internal.", Value: txt, TTL: 30 * time.Second},
+		{Type: "A", Name: "unowned.test.internal.", Value: "10.0.0.9", TTL: 30 * time.Second},
+		{Type: "TXT", Name: "api.test.internal.", Value: `"service=api namespace=default cluster=us region=us-east owner=test-owner created-by=nomad-external-dns"`, TTL: 30 * time.Second},
+		{Type: "A", Name: "api.test.internal.", Value: "10.0.1.1", TTL: 30 * time.Second},
+		// Records of a cluster which isn't synced by this instance.
+		{Type: "TXT", Name: "eu.test.internal.", Value: `"service=api namespace=default cluster=eu region=eu-west owner=test-owner created-by=nomad-external-dns"`, TTL: 30 * time.Second},
+		{Type: "A", Name: "eu.test.internal.", Value: "10.0.2.1", TTL: 30 * time.Second},
+	}
+
+	owned := make(map[string][]RecordMeta)
+	groupOwnedRecords(&owned, records, filterOwnedRecords(records, owner, []string{"us", "default"}, "default"), "test.internal.")
+
+	assert.Equal(t, map[string][]RecordMeta{
+		"redis.test.internal.": {
+			{Zone: "test.internal.", Records: []libdns.Record{{Type: "TXT", Name: "redis.", Value: txt, TTL: 30 * time.Second}}},
+			{Zone: "test.internal.", Records: []libdns.Record{{Type: "A", Name: "redis.", Value: "10.0.0.1,10.0.0.2", TTL: 30 * time.Second}}},
+			{Zone: "test.internal.", Records: []libdns.Record{{Type: "AAAA", Name: "redis.", Value: "2001:db8::1", TTL: 30 * time.Second}}},
+		},
+		"_redis._tcp.redis.test.internal.": {
+			{Zone: "test.internal.", Records: []libdns.Record{{Type: "SRV", Name: "_redis._tcp.redis.", Value: "10 10 6379 0b5a3c1e.redis.test.internal.,10 10 6380 9f1d2e3c.redis.test.internal.", TTL: 30 * time.Second}}},
+			{Zone: "test.internal.", Records: []libdns.Record{{Type: "TXT", Name: "_redis._tcp.redis.", Value: txt, TTL: 30 * time.Second}}},
+		},
+		"api.test.internal.": {
+			{Zone: "test.internal.", Records: []libdns.Record{{Type: "TXT", Name: "api.", Value: `"service=api namespace=default cluster=us region=us-east owner=test-owner created-by=nomad-external-dns"`, TTL: 30 * time.Second}}},
+			{Zone: "test.internal.", Records: []libdns.Record{{Type: "A", Name: "api.", Value: "10.0.1.1", TTL: 30 * time.Second}}},
+		},
+		"web.test.internal.": {
+			{Zone: "test.internal.", Records: []libdns.Record{{Type: "CNAME", Name: "web.", Value: "lb.example.com.", TTL: 30 * time.Second}}},
+		},
+		"_external-dns.web.test.internal.": {
+			{Zone: "test.internal.", Records: []libdns.Record{{Type: "TXT", Name: "_external-dns.web.", Value: txt, TTL: 30 * time.Second}}},
+		},
+	}, owned)
+}
+
+func TestDesiredState(t *testing.T) {
+	const txt = "service=%s namespace=default cluster=us owner=test-owner created-by=nomad-external-dns"
+	owned := func(name, typ, value string) RecordMeta {
+		return RecordMeta{Zone: "test.internal.", Records: []libdns.Record{{Type: typ, Name: name, Value: value, TTL: 30 * time.Second}}}
+	}
+
+	services := map[string]ServiceMeta{
+		"redis.test.internal.": {
+			Name:      "redis",
+			Namespace: "default",
+			Cluster:   "us",
+			DNSName:   "redis.test.internal",
+			Addresses: []string{"10.0.0.1"},
+			Tags:      []string{"external-dns/hostname=redis.test.internal", "external-dns/srv=true"},
+			Endpoints: []Endpoint{{AllocID: "0b5a3c1e-aaaa-bbbb-cccc-111111111111", Address: "10.0.0.1", Port: 6379}},
+		},
+		"api.test.internal.": {
+			Name:      "api",
+			Namespace: "default",
+			Cluster:   "us",
+			DNSName:   "api.test.internal",
+			Tags:      []string{"external-dns/hostname=api.test.internal", "external-dns/target=lb.example.com"},
+		},
+		// There are no addresses to publish, so the records are kept.
+		"db.test.internal.": {
+			Name:      "db",
+			Namespace: "default",
+			Cluster:   "us",
+			DNSName:   "db.test.internal",
+			Tags:      []string{"external-dns/hostname=db.test.internal"},
+		},
+		// None of the allocations are healthy, so the records are deleted.
+		"cache.test.internal.": {
+			Name:      "cache",
+			Namespace: "default",
+			Cluster:   "us",
+			DNSName:   "cache.test.internal",
+			Tags:      []string{"external-dns/hostname=cache.test.internal"},
+			Unhealthy: true,
+		},
+		// Service of a cluster which isn't synced.
+		"eu.test.internal.": {
+			Name:      "eu",
+			Namespace: "default",
+			Cluster:   "eu",
+			DNSName:   "eu.test.internal",
+			Addresses: []string{"10.0.2.1"},
+			Tags:      []string{"external-dns/hostname=eu.test.internal"},
+		},
+		// Service in the zone of another provider.
+		"web.example.com.": {
+			Name:      "web",
+			Namespace: "default",
+			Cluster:   "us",
+			DNSName:   "web.example.com",
+			Addresses: []string{"10.0.3.1"},
+			Tags:      []string{"external-dns/hostname=web.example.com"},
+		},
+	}
+	for key, svc := range services {
+		svc.Annotations = parseAnnotations(DefaultAnnotationPrefix, svc.Tags)
+		services[key] = svc
+	}
+
+	recordsMap := map[string][]RecordMeta{
+		"redis.test.internal.": {
+			owned("redis.", "TXT", fmt.Sprintf(txt, "redis")),
+			owned("redis.", "A", "10.0.0.2"), // Drifted from the address of the service.
+		},
+		"_redis._tcp.redis.test.internal.": {
+			owned("_redis._tcp.redis.", "TXT", fmt.Sprintf(txt, "redis")),
+			owned("_redis._tcp.redis.", "SRV", "10 10 6379 0b5a3c1e.redis.test.internal."),
+		},
+		"0b5a3c1e.redis.test.internal.": {
+			owned("0b5a3c1e.redis.", "TXT", fmt.Sprintf(txt, "redis")),
+			owned("0b5a3c1e.redis.", "A", "10.0.0.1"),
+		},
+		// Target of an allocation which is gone.
+		"9f1d2e3c.redis.test.internal.": {
+			owned("9f1d2e3c.redis.", "TXT", fmt.Sprintf(txt, "redis")),
+			owned("9f1d2e3c.redis.", "A", "10.0.0.2"),
+		},
+		"api.test.internal.": {
+			owned("api.", "CNAME", "lb.example.com."),
+		},
+		"_external-dns.api.test.internal.": {
+			owned("_external-dns.api.", "TXT", fmt.Sprintf(txt, "api")),
+		},
+		"db.test.internal.": {
+			owned("db.", "TXT", fmt.Sprintf(txt, "db")),
+			owned("db.", "A", "10.0.4.1"),
+		},
+		"cache.test.internal.": {
+			owned("cache.", "TXT", fmt.Sprintf(txt, "cache")),
+			owned("cache.", "A", "10.0.5.1"),
+		},
+	}
+
+	plan := newPlan(desiredState(services, recordsMap, []string{"test.internal", "example.com"}, []string{"test.internal"}, "test-owner", []string{"us"}))
+
+	assert.Empty(t, plan.Creates)
+	assert.Equal(t, []Change{{
+		Zone:     "test.internal.",
+		Record:   libdns.Record{Type: "A", Name: "redis", Value: "10.0.0.1", TTL: 30 * time.Second},
+		Previous: libdns.Record{Type: "A", Name: "redis.", Value: "10.0.0.2", TTL: 30 * time.Second},
+	}}, plan.Updates)
+	assert.Equal(t, []Change{
+		{Zone: "test.internal.", Record: libdns.Record{Type: "A", Name: "9f1d2e3c.redis.", Value: "10.0.0.2", TTL: 30 * time.Second}},
+		{Zone: "test.internal.", Record: libdns.Record{Type: "TXT", Name: "9f1d2e3c.redis.", Value: fmt.Sprintf(txt, "redis"), TTL: 30 * time.Second}},
+		{Zone: "test.internal.", Record: libdns.Record{Type: "A", Name: "cache.", Value: "10.0.5.1", TTL: 30 * time.Second}},
+		{Zone: "test.internal.", Record: libdns.Record{Type: "TXT", Name: "cache.", Value: fmt.Sprintf(txt, "cache"), TTL: 30 * time.Second}},
+	}, plan.Deletes)
+}
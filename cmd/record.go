@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,11 +19,7 @@ func (s *ServiceMeta) ToRecord(domains []string, owner string) (RecordMeta, erro
 		err  error
 	)
 
-	if len(s.Tags) == 0 {
-		return RecordMeta{}, fmt.Errorf("tags cannot be empty")
-	}
-
-	// Parse the hostname and TTL from tags.
+	// Parse the hostname and TTL from annotations.
 	host, zone, ttl, err = s.parseTags(domains)
 	if err != nil {
 		return RecordMeta{}, err
@@ -30,87 +27,305 @@ func (s *ServiceMeta) ToRecord(domains []string, owner string) (RecordMeta, erro
 
 	zone = EnsureFQDN(zone)
 
-	record := prepareRecord(s, host, zone, ttl, owner)
+	var record RecordMeta
+	if target, ok := s.parseTarget(); ok {
+		if host == "" {
+			return RecordMeta{}, fmt.Errorf("CNAME record can't be created at the zone apex")
+		}
+		record = prepareCNAMERecord(s, host, target, zone, ttl, owner)
+	} else {
+		if len(s.addressesByType()) == 0 {
+			return RecordMeta{}, fmt.Errorf("no valid addresses to publish for the address family")
+		}
+		record = prepareRecord(s, host, zone, ttl, owner)
+	}
+	record.Proxied = s.parseProxied()
+
+	if srv, ok := s.parseSRV(); ok {
+		record.Records = append(record.Records, prepareSRVRecords(s, srv, host, zone, ttl, owner)...)
+	}
+
 	return record, nil
 }
 
-// parseTags parses service tags to extract hostname, zone and ttl.
+// srvOpts holds the settings for the SRV records of a service.
+type srvOpts struct {
+	protocol string
+	priority int
+	weight   int
+}
+
+// parseSRV parses the SRV settings from service annotations.
+// It returns false if SRV records aren't enabled for the service.
+func (s *ServiceMeta) parseSRV() (srvOpts, bool) {
+	v, ok := s.Annotations.get(SRVAnnotationKey)
+	if enabled, err := strconv.ParseBool(v); !ok || err != nil || !enabled {
+		return srvOpts{}, false
+	}
+
+	opts := srvOpts{
+		protocol: DefaultSRVProtocol,
+		priority: DefaultSRVPriority,
+		weight:   DefaultSRVWeight,
+	}
+	if v, ok := s.Annotations.get(SRVProtocolAnnotationKey); ok && v != "" {
+		opts.protocol = strings.ToLower(v)
+	}
+	if v, ok := s.Annotations.get(SRVPriorityAnnotationKey); ok {
+		if p, err := strconv.ParseUint(v, 10, 16); err == nil {
+			opts.priority = int(p)
+		}
+	}
+	if v, ok := s.Annotations.get(SRVWeightAnnotationKey); ok {
+		if w, err := strconv.ParseUint(v, 10, 16); err == nil {
+			opts.weight = int(w)
+		}
+	}
+	return opts, true
+}
+
+// parseTags parses service annotations to extract ttl, along with the host and zone of the DNS name of the service.
 func (s *ServiceMeta) parseTags(domains []string) (host, zone string, ttl time.Duration, err error) {
-	for _, tag := range s.Tags {
-		if strings.HasPrefix(tag, HostnameAnnotationKey) {
-			host, zone, err = parseHost(tag, domains)
-			if err != nil {
-				return
-			}
-		} else if strings.HasPrefix(tag, TTLAnnotationKey) {
-			ttl, err = parseTTL(tag)
-			if err != nil {
-				ttl = DefaultTTL
-			}
+	host, zone, err = parseHost(s.DNSName, domains)
+	if err != nil {
+		return
+	}
+
+	ttl = DefaultTTL
+	if v, ok := s.Annotations.get(TTLAnnotationKey); ok {
+		if parsed, err := parseTTL(v); err == nil {
+			ttl = parsed
 		}
 	}
 	return
 }
 
-// parseHost extracts host and zone from a given tag.
-func parseHost(tag string, domains []string) (host, zone string, err error) {
-	split := strings.Split(tag, HostnameAnnotationKey+"=")
-	if len(split) != 2 {
-		return "", "", fmt.Errorf("error splitting tag %s: expected 2 elements, got %d", tag, len(split))
+// parseProxied parses the Cloudflare proxy setting from service annotations.
+// It returns nil if the annotation is absent or unparseable.
+func (s *ServiceMeta) parseProxied() *bool {
+	v, ok := s.Annotations.get(CloudflareProxiedAnnotationKey)
+	if !ok {
+		return nil
+	}
+	proxied, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil
+	}
+	return &proxied
+}
+
+// parseTarget parses the CNAME target from service annotations.
+// It returns false if the service should be published with its addresses.
+func (s *ServiceMeta) parseTarget() (string, bool) {
+	target, ok := s.Annotations.get(TargetAnnotationKey)
+	if target = strings.TrimSpace(target); !ok || target == "" {
+		return "", false
+	}
+	return EnsureFQDN(target), true
+}
+
+// parseHost extracts host and zone from a given hostname.
+func parseHost(hostname string, domains []string) (host, zone string, err error) {
+	if hostname == "" {
+		return "", "", fmt.Errorf("hostname cannot be empty")
 	}
 
 	// For a given list of domain filters, determine if the hostname belongs to that domain.
+	// The longest matching domain wins, so that nested zones (e.g. `internal.example.com` within
+	// `example.com`) owned by different providers are routed correctly.
+	name := strings.TrimSuffix(hostname, ".")
 	for _, domain := range domains {
-		if strings.Contains(split[1], domain) {
-			// If a valid domain is found, return the host and domain separately.
-			return strings.TrimRight(strings.Split(split[1], domain)[0], "."), domain, nil
+		d := strings.TrimSuffix(domain, ".")
+		if (name == d || strings.HasSuffix(name, "."+d)) && len(d) > len(zone) {
+			host, zone = strings.TrimSuffix(strings.TrimSuffix(name, d), "."), d
 		}
 	}
 
-	return "", "", fmt.Errorf("hostname doesn't contain a valid domain TLD")
+	if zone == "" {
+		return "", "", fmt.Errorf("hostname doesn't contain a valid domain TLD")
+	}
+
+	// If a valid domain is found, return the host and domain separately.
+	return host, zone, nil
 }
 
-// parseTTL extracts ttl from a given tag.
-func parseTTL(tag string) (ttl time.Duration, err error) {
-	split := strings.Split(tag, TTLAnnotationKey+"=")
-	if len(split) != 2 {
-		return -1, fmt.Errorf("error splitting tag %s: expected 2 elements, got %d", tag, len(split))
-	}
-	ttl, err = time.ParseDuration(split[1])
+// parseTTL extracts ttl from the value of a TTL annotation.
+func parseTTL(value string) (ttl time.Duration, err error) {
+	ttl, err = time.ParseDuration(value)
 	if err != nil {
 		return -1, err
 	}
 	return ttl, nil
 }
 
+// prepareRecord creates an A record set with the IPv4 addresses and an AAAA record set with the IPv6 addresses
+// of the service, along with a TXT record with metadata.
 func prepareRecord(s *ServiceMeta, host, zone string, ttl time.Duration, owner string) RecordMeta {
-	// Generate comma-separated list of addresses
-	addresses := strings.Join(s.Addresses, ",")
-
-	// Create an A record with all addresses
-	aRecord := libdns.Record{
-		Type:  "A",
-		Name:  host,
-		Value: addresses,
-		TTL:   ttl,
-	}
+	records := make([]libdns.Record, 0, 3)
 
-	// Create a TXT record with metadata
-	txtRecord := libdns.Record{
-		Type: "TXT",
-		Name: host,
-		Value: fmt.Sprintf(
-			"service=%s namespace=%s owner=%s created-by=nomad-external-dns",
-			s.Name, s.Namespace, owner,
-		),
-		TTL: ttl,
+	// Create an A and AAAA record with all addresses of the respective family.
+	addresses := s.addressesByType()
+	for _, typ := range []string{"A", "AAAA"} {
+		if len(addresses[typ]) == 0 {
+			continue
+		}
+		records = append(records, libdns.Record{
+			Type:  typ,
+			Name:  host,
+			Value: strings.Join(addresses[typ], ","), // Generate comma-separated list of addresses
+			TTL:   ttl,
+		})
 	}
 
-	// Combine the A and TXT records
-	records := []libdns.Record{aRecord, txtRecord}
+	// Create a TXT record with metadata
+	records = append(records, ownershipRecord(s, host, ttl, owner))
 
 	return RecordMeta{
 		Zone:    zone,
 		Records: records,
 	}
 }
+
+// prepareCNAMERecord creates a CNAME record pointing to the target, along with a TXT record with metadata.
+// The TXT record is placed at a prefixed name, as a CNAME can't coexist with other records.
+func prepareCNAMERecord(s *ServiceMeta, host, target, zone string, ttl time.Duration, owner string) RecordMeta {
+	return RecordMeta{
+		Zone: zone,
+		Records: []libdns.Record{
+			{Type: "CNAME", Name: host, Value: target, TTL: ttl},
+			ownershipRecord(s, ownershipName(host), ttl, owner),
+		},
+	}
+}
+
+// addressesByType classifies the addresses of the service by the type of address record (A or AAAA).
+// Only the address family set with the AddressFamilyAnnotationKey annotation is included, if present.
+// Addresses which aren't valid IP addresses are skipped.
+func (s *ServiceMeta) addressesByType() map[string][]string {
+	addresses := make(map[string][]string, 2)
+	for _, addr := range s.Addresses {
+		if typ, value := addressRecord(addr); typ != "" && s.allowsRecordType(typ) && !Contains(addresses[typ], value) {
+			addresses[typ] = append(addresses[typ], value)
+		}
+	}
+	return addresses
+}
+
+// allowsRecordType checks if the address record type (A or AAAA) is allowed by the address family of the service.
+func (s *ServiceMeta) allowsRecordType(typ string) bool {
+	family, _ := s.Annotations.get(AddressFamilyAnnotationKey)
+	switch strings.ToLower(family) {
+	case AddressFamilyIPv4:
+		return typ == "A"
+	case AddressFamilyIPv6:
+		return typ == "AAAA"
+	default:
+		return true
+	}
+}
+
+// prepareSRVRecords creates an SRV record set for the service with one target per allocation,
+// along with an A or AAAA record for every target. Each name gets its own TXT record so that it can be pruned.
+func prepareSRVRecords(s *ServiceMeta, srv srvOpts, host, zone string, ttl time.Duration, owner string) []libdns.Record {
+	var (
+		name    = srvName(s.Name, srv.protocol, host)
+		targets = make([]string, 0, len(s.Endpoints))
+		records = make([]libdns.Record, 0, 2*len(s.Endpoints)+2)
+	)
+
+	for _, e := range s.Endpoints {
+		typ, value := addressRecord(e.Address)
+		if typ == "" || !s.allowsRecordType(typ) {
+			continue
+		}
+
+		target := srvTargetName(e.AllocID, host)
+		targets = append(targets, fmt.Sprintf("%d %d %d %s", srv.priority, srv.weight, e.Port, libdns.AbsoluteName(target, zone)))
+		records = append(records,
+			libdns.Record{Type: typ, Name: target, Value: value, TTL: ttl},
+			ownershipRecord(s, target, ttl, owner),
+		)
+	}
+
+	return append(records,
+		libdns.Record{Type: "SRV", Name: name, Value: strings.Join(targets, ","), TTL: ttl},
+		ownershipRecord(s, name, ttl, owner),
+	)
+}
+
+// ownershipRecord creates the TXT record which marks a name as owned by this program.
+// The Nomad cluster and region of the service are recorded, so that a cluster never prunes the records of another.
+func ownershipRecord(s *ServiceMeta, name string, ttl time.Duration, owner string) libdns.Record {
+	fields := []string{"service=" + s.Name, "namespace=" + s.Namespace}
+	if s.Cluster != "" {
+		fields = append(fields, "cluster="+s.Cluster)
+	}
+	if s.Region != "" {
+		fields = append(fields, "region="+s.Region)
+	}
+	fields = append(fields, "owner="+owner, "created-by=nomad-external-dns")
+
+	return libdns.Record{
+		Type:  "TXT",
+		Name:  name,
+		Value: strings.Join(fields, " "),
+		TTL:   ttl,
+	}
+}
+
+// parseOwnershipRecord parses the `key=value` fields of the value of a TXT ownership record.
+func parseOwnershipRecord(value string) map[string]string {
+	fields := make(map[string]string)
+	for _, f := range strings.Fields(strings.Trim(value, `"`)) {
+		if k, v, ok := strings.Cut(f, "="); ok {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+// ownershipName returns the name of the TXT ownership record for a CNAME, in the form of `_external-dns.host`.
+func ownershipName(host string) string {
+	return joinName(OwnershipRecordPrefix, host)
+}
+
+// srvName returns the name of the SRV record set of a service, in the form of `_service._proto.host`.
+func srvName(service, protocol, host string) string {
+	return joinName(fmt.Sprintf("_%s._%s", service, protocol), host)
+}
+
+// srvTargetName returns the name of the SRV target for an allocation, in the form of `alloc.host`.
+// The short allocation ID is used, as in the rest of Nomad.
+func srvTargetName(allocID, host string) string {
+	if len(allocID) > 8 {
+		allocID = allocID[:8]
+	}
+	return joinName(allocID, host)
+}
+
+// joinName prefixes a label to a name, which may be empty for the zone apex.
+func joinName(label, name string) string {
+	if name == "" {
+		return label
+	}
+	return label + "." + name
+}
+
+// recordNames returns the fully qualified names of all the records created for the service.
+func (s *ServiceMeta) recordNames() []string {
+	fqdn := EnsureFQDN(s.DNSName)
+	names := []string{fqdn}
+	if _, ok := s.parseTarget(); ok {
+		names = append(names, ownershipName(fqdn))
+	}
+
+	if srv, ok := s.parseSRV(); ok {
+		names = append(names, srvName(s.Name, srv.protocol, fqdn))
+		for _, e := range s.Endpoints {
+			if typ, _ := addressRecord(e.Address); typ != "" && s.allowsRecordType(typ) {
+				names = append(names, srvTargetName(e.AllocID, fqdn))
+			}
+		}
+	}
+	return names
+}
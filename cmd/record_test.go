@@ -24,6 +24,7 @@ func TestToRecord(t *testing.T) {
 				Namespace: "default",
 				Job:       "redis-job",
 				Addresses: []string{"192.168.1.1"},
+				DNSName:   "redis.test.internal",
 				Tags:      []string{"external-dns/hostname=redis.test.internal", "external-dns/ttl=30s"},
 			},
 			domains: []string{"test.internal"},
@@ -46,6 +47,215 @@ func TestToRecord(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "cloudflare proxied",
+			service: &ServiceMeta{
+				Name:      "web",
+				Namespace: "default",
+				Job:       "web-job",
+				Addresses: []string{"192.168.1.1", "192.168.1.2"},
+				DNSName:   "web.test.internal",
+				Tags:      []string{"external-dns/hostname=web.test.internal", "external-dns/cloudflare-proxied=true"},
+			},
+			domains: []string{"test.internal"},
+			owner:   "test-owner",
+			want: RecordMeta{
+				Zone:    "test.internal.",
+				Proxied: func() *bool { b := true; return &b }(),
+				Records: []libdns.Record{
+					{
+						Type:  "A",
+						Name:  "web",
+						Value: "192.168.1.1,192.168.1.2",
+						TTL:   30 * time.Second,
+					},
+					{
+						Type:  "TXT",
+						Name:  "web",
+						Value: "service=web namespace=default owner=test-owner created-by=nomad-external-dns",
+						TTL:   30 * time.Second,
+					},
+				},
+			},
+		},
+		{
+			name: "dual stack",
+			service: &ServiceMeta{
+				Name:      "web",
+				Namespace: "default",
+				Addresses: []string{"192.168.1.1", "2001:db8::1", "::ffff:192.168.1.2", "::ffff:192.168.1.1"},
+				DNSName:   "web.test.internal",
+				Tags:      []string{"external-dns/hostname=web.test.internal"},
+			},
+			domains: []string{"test.internal"},
+			owner:   "test-owner",
+			want: RecordMeta{
+				Zone: "test.internal.",
+				Records: []libdns.Record{
+					{Type: "A", Name: "web", Value: "192.168.1.1,192.168.1.2", TTL: 30 * time.Second},
+					{Type: "AAAA", Name: "web", Value: "2001:db8::1", TTL: 30 * time.Second},
+					{Type: "TXT", Name: "web", Value: "service=web namespace=default owner=test-owner created-by=nomad-external-dns", TTL: 30 * time.Second},
+				},
+			},
+		},
+		{
+			name: "ipv6 only",
+			service: &ServiceMeta{
+				Name:      "web",
+				Namespace: "default",
+				Addresses: []string{"192.168.1.1", "2001:db8::1"},
+				DNSName:   "web.test.internal",
+				Tags:      []string{"external-dns/hostname=web.test.internal", "external-dns/address-family=ipv6"},
+			},
+			domains: []string{"test.internal"},
+			owner:   "test-owner",
+			want: RecordMeta{
+				Zone: "test.internal.",
+				Records: []libdns.Record{
+					{Type: "AAAA", Name: "web", Value: "2001:db8::1", TTL: 30 * time.Second},
+					{Type: "TXT", Name: "web", Value: "service=web namespace=default owner=test-owner created-by=nomad-external-dns", TTL: 30 * time.Second},
+				},
+			},
+		},
+		{
+			name: "no addresses of the address family",
+			service: &ServiceMeta{
+				Name:      "web",
+				Namespace: "default",
+				Addresses: []string{"192.168.1.1"},
+				DNSName:   "web.test.internal",
+				Tags:      []string{"external-dns/hostname=web.test.internal", "external-dns/address-family=ipv6"},
+			},
+			domains:   []string{"test.internal"},
+			owner:     "test-owner",
+			wantError: true,
+		},
+		{
+			name: "cname target",
+			service: &ServiceMeta{
+				Name:      "web",
+				Namespace: "default",
+				Addresses: []string{"192.168.1.1"},
+				DNSName:   "web.test.internal",
+				Tags:      []string{"external-dns/hostname=web.test.internal", "external-dns/target=lb.example.com"},
+			},
+			domains: []string{"test.internal"},
+			owner:   "test-owner",
+			want: RecordMeta{
+				Zone: "test.internal.",
+				Records: []libdns.Record{
+					{Type: "CNAME", Name: "web", Value: "lb.example.com.", TTL: 30 * time.Second},
+					{Type: "TXT", Name: "_external-dns.web", Value: "service=web namespace=default owner=test-owner created-by=nomad-external-dns", TTL: 30 * time.Second},
+				},
+			},
+		},
+		{
+			name: "cname target at zone apex",
+			service: &ServiceMeta{
+				Name:      "web",
+				Namespace: "default",
+				DNSName:   "test.internal",
+				Tags:      []string{"external-dns/hostname=test.internal", "external-dns/target=lb.example.com"},
+			},
+			domains:   []string{"test.internal"},
+			owner:     "test-owner",
+			wantError: true,
+		},
+		{
+			name: "cluster and region",
+			service: &ServiceMeta{
+				Name:      "web",
+				Namespace: "default",
+				Cluster:   "eu",
+				Region:    "eu-west",
+				Addresses: []string{"192.168.1.1"},
+				DNSName:   "web.test.internal",
+				Tags:      []string{"external-dns/hostname=web.test.internal"},
+			},
+			domains: []string{"test.internal"},
+			owner:   "test-owner",
+			want: RecordMeta{
+				Zone: "test.internal.",
+				Records: []libdns.Record{
+					{Type: "A", Name: "web", Value: "192.168.1.1", TTL: 30 * time.Second},
+					{Type: "TXT", Name: "web", Value: "service=web namespace=default cluster=eu region=eu-west owner=test-owner created-by=nomad-external-dns", TTL: 30 * time.Second},
+				},
+			},
+		},
+		{
+			name: "nested zone",
+			service: &ServiceMeta{
+				Name:      "redis",
+				Namespace: "default",
+				Job:       "redis-job",
+				Addresses: []string{"192.168.1.1"},
+				DNSName:   "redis.internal.example.com",
+				Tags:      []string{"external-dns/hostname=redis.internal.example.com"},
+			},
+			domains: []string{"example.com", "internal.example.com"},
+			owner:   "test-owner",
+			want: RecordMeta{
+				Zone: "internal.example.com.",
+				Records: []libdns.Record{
+					{
+						Type:  "A",
+						Name:  "redis",
+						Value: "192.168.1.1",
+						TTL:   30 * time.Second,
+					},
+					{
+						Type:  "TXT",
+						Name:  "redis",
+						Value: "service=redis namespace=default owner=test-owner created-by=nomad-external-dns",
+						TTL:   30 * time.Second,
+					},
+				},
+			},
+		},
+		{
+			name: "hostname outside domain filters",
+			service: &ServiceMeta{
+				Name:      "redis",
+				Namespace: "default",
+				Job:       "redis-job",
+				Addresses: []string{"192.168.1.1"},
+				DNSName:   "redis.nottest.internal",
+				Tags:      []string{"external-dns/hostname=redis.nottest.internal"},
+			},
+			domains:   []string{"test.internal"},
+			owner:     "test-owner",
+			wantError: true,
+		},
+		{
+			name: "srv records",
+			service: &ServiceMeta{
+				Name:      "redis",
+				Namespace: "default",
+				Job:       "redis-job",
+				Addresses: []string{"192.168.1.1", "192.168.1.2"},
+				Endpoints: []Endpoint{
+					{AllocID: "0b5a3c1e-aaaa-bbbb-cccc-111111111111", Address: "192.168.1.1", Port: 6379},
+					{AllocID: "9f1d2e3c-aaaa-bbbb-cccc-222222222222", Address: "192.168.1.2", Port: 6380},
+				},
+				DNSName: "redis.test.internal",
+				Tags:    []string{"external-dns/hostname=redis.test.internal", "external-dns/srv=true", "external-dns/srv-weight=5"},
+			},
+			domains: []string{"test.internal"},
+			owner:   "test-owner",
+			want: RecordMeta{
+				Zone: "test.internal.",
+				Records: []libdns.Record{
+					{Type: "A", Name: "redis", Value: "192.168.1.1,192.168.1.2", TTL: 30 * time.Second},
+					{Type: "TXT", Name: "redis", Value: "service=redis namespace=default owner=test-owner created-by=nomad-external-dns", TTL: 30 * time.Second},
+					{Type: "A", Name: "0b5a3c1e.redis", Value: "192.168.1.1", TTL: 30 * time.Second},
+					{Type: "TXT", Name: "0b5a3c1e.redis", Value: "service=redis namespace=default owner=test-owner created-by=nomad-external-dns", TTL: 30 * time.Second},
+					{Type: "A", Name: "9f1d2e3c.redis", Value: "192.168.1.2", TTL: 30 * time.Second},
+					{Type: "TXT", Name: "9f1d2e3c.redis", Value: "service=redis namespace=default owner=test-owner created-by=nomad-external-dns", TTL: 30 * time.Second},
+					{Type: "SRV", Name: "_redis._tcp.redis", Value: "10 5 6379 0b5a3c1e.redis.test.internal.,10 5 6380 9f1d2e3c.redis.test.internal.", TTL: 30 * time.Second},
+					{Type: "TXT", Name: "_redis._tcp.redis", Value: "service=redis namespace=default owner=test-owner created-by=nomad-external-dns", TTL: 30 * time.Second},
+				},
+			},
+		},
 		{
 			name: "empty tags",
 			service: &ServiceMeta{
@@ -63,6 +273,7 @@ func TestToRecord(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			tt.service.Annotations = parseAnnotations(DefaultAnnotationPrefix, tt.service.Tags)
 			got, err := tt.service.ToRecord(tt.domains, tt.owner)
 			if tt.wantError {
 				assert.Error(t, err)
@@ -73,3 +284,37 @@ func TestToRecord(t *testing.T) {
 		})
 	}
 }
+
+func TestServiceByHostname(t *testing.T) {
+	svc := ServiceMeta{
+		Name:      "web",
+		Namespace: "default",
+		Addresses: []string{"192.168.1.1"},
+		Tags: []string{
+			"external-dns/hostname=web.test.internal, www.test.internal",
+			"external-dns/hostname=web.example.com",
+			"external-dns/hostname=www.test.internal",
+		},
+	}
+
+	svc.Annotations = parseAnnotations(DefaultAnnotationPrefix, svc.Tags)
+	svc.DNSNames = getDNSNames(svc.Annotations)
+	assert.Equal(t, []string{"web.test.internal", "www.test.internal", "web.example.com"}, svc.DNSNames)
+
+	services := svc.byHostname()
+	assert.Len(t, services, 3)
+	for key, name := range map[string]string{
+		"web.test.internal.": "web.test.internal",
+		"www.test.internal.": "www.test.internal",
+		"web.example.com.":   "web.example.com",
+	} {
+		assert.Equal(t, name, services[key].DNSName)
+		assert.Equal(t, "web", services[key].Name)
+	}
+
+	// Every hostname is published in its own zone.
+	example := services["web.example.com."]
+	record, err := example.ToRecord([]string{"test.internal", "example.com"}, "test-owner")
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com.", record.Zone)
+}
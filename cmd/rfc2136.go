@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+)
+
+const (
+	// tsigFudge is the allowed clock skew in seconds for TSIG signed messages.
+	tsigFudge = 300
+)
+
+// rfc2136Opts represents the configuration for the RFC 2136 provider.
+type rfc2136Opts struct {
+	Nameserver    string // Address of the primary nameserver as host:port.
+	TSIGKeyName   string
+	TSIGSecret    string // Base64 encoded TSIG secret.
+	TSIGAlgorithm string
+	Timeout       time.Duration
+}
+
+// RFC2136Provider implements the DNSProvider interface by sending DNS UPDATE
+// messages (RFC 2136) to a nameserver. Records are listed with a zone transfer (AXFR).
+// Multiple values of a record are passed as a comma separated `Value`.
+type RFC2136Provider struct {
+	opts rfc2136Opts
+}
+
+// NewRFC2136Provider initialises a RFC 2136 provider.
+func NewRFC2136Provider(opts rfc2136Opts) (*RFC2136Provider, error) {
+	if opts.Nameserver == "" {
+		return nil, fmt.Errorf("rfc2136 nameserver is required")
+	}
+	if opts.TSIGKeyName != "" {
+		if opts.TSIGSecret == "" {
+			return nil, fmt.Errorf("rfc2136 tsig_secret is required when tsig_key_name is set")
+		}
+		opts.TSIGKeyName = dns.Fqdn(opts.TSIGKeyName)
+	}
+	if opts.TSIGAlgorithm == "" {
+		opts.TSIGAlgorithm = dns.HmacSHA256
+	}
+	opts.TSIGAlgorithm = dns.Fqdn(opts.TSIGAlgorithm)
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Second * 10
+	}
+
+	return &RFC2136Provider{opts: opts}, nil
+}
+
+// GetRecords lists all the records in the zone using a zone transfer. Record names are returned as FQDNs.
+func (p *RFC2136Provider) GetRecords(ctx context.Context, zone string) ([]libdns.Record, error) {
+	m := new(dns.Msg)
+	m.SetAxfr(dns.Fqdn(zone))
+	p.sign(m)
+
+	t := &dns.Transfer{
+		DialTimeout:  p.opts.Timeout,
+		ReadTimeout:  p.opts.Timeout,
+		WriteTimeout: p.opts.Timeout,
+		TsigSecret:   p.tsigSecret(),
+	}
+	envs, err := t.In(m, p.opts.Nameserver)
+	if err != nil {
+		return nil, fmt.Errorf("error starting zone transfer for %s: %w", zone, err)
+	}
+
+	var records []libdns.Record
+	for env := range envs {
+		if env.Error != nil {
+			return nil, fmt.Errorf("error during zone transfer for %s: %w", zone, env.Error)
+		}
+		for _, rr := range env.RR {
+			// The SOA record marks the start and end of the transfer.
+			if rr.Header().Rrtype == dns.TypeSOA {
+				continue
+			}
+			records = append(records, rrToRecord(rr))
+		}
+	}
+	return records, nil
+}
+
+// AppendRecords adds records to the zone. It returns the records that were added.
+func (p *RFC2136Provider) AppendRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zone))
+
+	for _, record := range records {
+		rrs, err := recordToRRs(record, zone)
+		if err != nil {
+			return nil, err
+		}
+		m.Insert(rrs)
+	}
+
+	if err := p.exchange(ctx, m); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// SetRecords replaces the record sets of the given records in the zone.
+// All the records are updated atomically in a single DNS UPDATE message.
+func (p *RFC2136Provider) SetRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zone))
+
+	for _, record := range records {
+		rrs, err := recordToRRs(record, zone)
+		if err != nil {
+			return nil, err
+		}
+		m.RemoveRRset(rrs[:1])
+		m.Insert(rrs)
+	}
+
+	if err := p.exchange(ctx, m); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// DeleteRecords deletes the given values of the records from the zone.
+// If a record has no value, its entire record set is deleted. It returns the records that were deleted.
+func (p *RFC2136Provider) DeleteRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zone))
+
+	for _, record := range records {
+		if record.Value == "" {
+			m.RemoveRRset([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{
+				Name:   libdns.AbsoluteName(record.Name, dns.Fqdn(zone)),
+				Rrtype: dns.StringToType[record.Type],
+				Class:  dns.ClassINET,
+			}}})
+			continue
+		}
+
+		rrs, err := recordToRRs(record, zone)
+		if err != nil {
+			return nil, err
+		}
+		m.Remove(rrs)
+	}
+
+	if err := p.exchange(ctx, m); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// exchange signs and sends an UPDATE message to the nameserver and checks the response code.
+func (p *RFC2136Provider) exchange(ctx context.Context, m *dns.Msg) error {
+	p.sign(m)
+
+	c := &dns.Client{
+		Net:        "tcp",
+		Timeout:    p.opts.Timeout,
+		TsigSecret: p.tsigSecret(),
+	}
+	resp, _, err := c.ExchangeContext(ctx, m, p.opts.Nameserver)
+	if err != nil {
+		return fmt.Errorf("error sending dns update: %w", err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("dns update failed: %s", dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
+
+// sign adds a TSIG record to the message if a key is configured.
+func (p *RFC2136Provider) sign(m *dns.Msg) {
+	if p.opts.TSIGKeyName == "" {
+		return
+	}
+	m.SetTsig(p.opts.TSIGKeyName, p.opts.TSIGAlgorithm, tsigFudge, time.Now().Unix())
+}
+
+// tsigSecret returns the TSIG secret keyed by the key name, as expected by the dns client.
+func (p *RFC2136Provider) tsigSecret() map[string]string {
+	if p.opts.TSIGKeyName == "" {
+		return nil
+	}
+	return map[string]string{p.opts.TSIGKeyName: p.opts.TSIGSecret}
+}
+
+// recordToRRs converts every value of a libdns record into a resource record.
+// Values are expected in the presentation format of the record's RDATA, as in a zone file.
+func recordToRRs(record libdns.Record, zone string) ([]dns.RR, error) {
+	var (
+		name   = libdns.AbsoluteName(record.Name, dns.Fqdn(zone))
+		values = splitValues(record.Value)
+		rrs    = make([]dns.RR, 0, len(values))
+	)
+
+	if len(values) == 0 {
+		return nil, fmt.Errorf("record %s %s has no value", name, record.Type)
+	}
+
+	for _, value := range values {
+		if record.Type == "TXT" && !strings.HasPrefix(value, `"`) {
+			value = strconv.Quote(value)
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", name, int(record.TTL.Seconds()), record.Type, value))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing record %s %s: %w", name, record.Type, err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// rrToRecord converts a resource record into a libdns record with the RDATA in presentation format as the value.
+func rrToRecord(rr dns.RR) libdns.Record {
+	hdr := rr.Header()
+	return libdns.Record{
+		Type:  dns.TypeToString[hdr.Rrtype],
+		Name:  hdr.Name,
+		Value: strings.TrimSpace(strings.TrimPrefix(rr.String(), hdr.String())),
+		TTL:   time.Duration(hdr.Ttl) * time.Second,
+	}
+}
+
+// Interface guards
+var (
+	_ DNSProvider = (*RFC2136Provider)(nil)
+)
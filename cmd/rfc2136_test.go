@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testTSIGKey    = "test-key."
+	testTSIGSecret = "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+	testZone       = "test.internal."
+)
+
+// fakeNameserver is an in-process authoritative nameserver
+// which accepts TSIG signed DNS UPDATE and AXFR requests for a single zone.
+type fakeNameserver struct {
+	sync.Mutex
+	rrs []dns.RR
+}
+
+func (f *fakeNameserver) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	if r.IsTsig() == nil || w.TsigStatus() != nil {
+		m.Rcode = dns.RcodeNotAuth
+		_ = w.WriteMsg(m)
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if r.Opcode == dns.OpcodeUpdate {
+		for _, rr := range r.Ns {
+			f.apply(rr)
+		}
+		m.SetTsig(testTSIGKey, dns.HmacSHA256, tsigFudge, time.Now().Unix())
+		_ = w.WriteMsg(m)
+		return
+	}
+
+	if len(r.Question) == 1 && r.Question[0].Qtype == dns.TypeAXFR {
+		soa, _ := dns.NewRR(testZone + " 3600 IN SOA ns.test.internal. admin.test.internal. 1 3600 600 86400 60")
+		ch := make(chan *dns.Envelope)
+		tr := new(dns.Transfer)
+		go func() {
+			ch <- &dns.Envelope{RR: append(append([]dns.RR{soa}, f.rrs...), soa)}
+			close(ch)
+		}()
+		_ = tr.Out(w, r, ch)
+		return
+	}
+
+	m.Rcode = dns.RcodeRefused
+	_ = w.WriteMsg(m)
+}
+
+// apply applies a single RR from the update section of a message, as per RFC 2136 section 3.4.2.
+func (f *fakeNameserver) apply(rr dns.RR) {
+	hdr := rr.Header()
+	switch hdr.Class {
+	case dns.ClassANY:
+		f.filter(func(e dns.RR) bool {
+			return e.Header().Name == hdr.Name && e.Header().Rrtype == hdr.Rrtype
+		})
+	case dns.ClassNONE:
+		f.filter(func(e dns.RR) bool {
+			c := dns.Copy(rr)
+			c.Header().Class, c.Header().Ttl = dns.ClassINET, e.Header().Ttl
+			return dns.IsDuplicate(e, c)
+		})
+	default:
+		f.rrs = append(f.rrs, rr)
+	}
+}
+
+// filter removes all RRs matching the given function.
+func (f *fakeNameserver) filter(match func(dns.RR) bool) {
+	kept := f.rrs[:0]
+	for _, e := range f.rrs {
+		if !match(e) {
+			kept = append(kept, e)
+		}
+	}
+	f.rrs = kept
+}
+
+func newTestRFC2136(t *testing.T) (*RFC2136Provider, *fakeNameserver) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ns := &fakeNameserver{}
+	started := make(chan struct{})
+	srv := &dns.Server{
+		Listener:          l,
+		Handler:           ns,
+		TsigSecret:        map[string]string{testTSIGKey: testTSIGSecret},
+		NotifyStartedFunc: func() { close(started) },
+		// The default accept func rejects UPDATE messages.
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	p, err := NewRFC2136Provider(rfc2136Opts{
+		Nameserver:  l.Addr().String(),
+		TSIGKeyName: "test-key",
+		TSIGSecret:  testTSIGSecret,
+	})
+	require.NoError(t, err)
+	return p, ns
+}
+
+// values returns the sorted values of records with the given name and type.
+func values(records []libdns.Record, name, typ string) []string {
+	out := make([]string, 0)
+	for _, r := range records {
+		if r.Name == name && r.Type == typ {
+			out = append(out, r.Value)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestRFC2136SetAndGetRecords(t *testing.T) {
+	p, _ := newTestRFC2136(t)
+	ctx := context.Background()
+
+	_, err := p.SetRecords(ctx, testZone, []libdns.Record{
+		{Type: "A", Name: "redis", Value: "10.0.0.1,10.0.0.2", TTL: 30 * time.Second},
+		{Type: "TXT", Name: "redis", Value: "service=redis owner=test", TTL: 30 * time.Second},
+	})
+	require.NoError(t, err)
+
+	records, err := p.GetRecords(ctx, testZone)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, values(records, "redis.test.internal.", "A"))
+	assert.Equal(t, []string{`"service=redis owner=test"`}, values(records, "redis.test.internal.", "TXT"))
+
+	// Setting the record again replaces the entire record set.
+	_, err = p.SetRecords(ctx, testZone, []libdns.Record{
+		{Type: "A", Name: "redis", Value: "10.0.0.3", TTL: 60 * time.Second},
+	})
+	require.NoError(t, err)
+
+	records, err = p.GetRecords(ctx, testZone)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.3"}, values(records, "redis.test.internal.", "A"))
+	for _, r := range records {
+		if r.Type == "A" {
+			assert.Equal(t, 60*time.Second, r.TTL)
+		}
+	}
+}
+
+func TestRFC2136DeleteRecords(t *testing.T) {
+	p, _ := newTestRFC2136(t)
+	ctx := context.Background()
+
+	_, err := p.AppendRecords(ctx, testZone, []libdns.Record{
+		{Type: "A", Name: "redis", Value: "10.0.0.1,10.0.0.2", TTL: 30 * time.Second},
+		{Type: "A", Name: "web", Value: "10.0.0.5", TTL: 30 * time.Second},
+		{Type: "TXT", Name: "web", Value: "owner=test", TTL: 30 * time.Second},
+	})
+	require.NoError(t, err)
+
+	// Names relative to the zone, as produced by the pruner, must be resolved.
+	_, err = p.DeleteRecords(ctx, testZone, []libdns.Record{
+		{Type: "A", Name: "redis.", Value: "10.0.0.1"},
+		{Type: "TXT", Name: "web"},
+	})
+	require.NoError(t, err)
+
+	records, err := p.GetRecords(ctx, testZone)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.2"}, values(records, "redis.test.internal.", "A"))
+	assert.Equal(t, []string{"10.0.0.5"}, values(records, "web.test.internal.", "A"))
+	assert.Empty(t, values(records, "web.test.internal.", "TXT"))
+}
+
+func TestRFC2136InvalidTSIG(t *testing.T) {
+	p, _ := newTestRFC2136(t)
+	p.opts.TSIGSecret = "d3Jvbmctc2VjcmV0"
+
+	_, err := p.SetRecords(context.Background(), testZone, []libdns.Record{
+		{Type: "A", Name: "redis", Value: "10.0.0.1", TTL: 30 * time.Second},
+	})
+	assert.Error(t, err)
+
+	_, err = NewRFC2136Provider(rfc2136Opts{})
+	assert.Error(t, err)
+}
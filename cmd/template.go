@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// initHostnameTemplate parses the template used to derive the hostname of services without a hostname annotation.
+// It returns nil if no template is configured.
+func initHostnameTemplate(tpl string) (*template.Template, error) {
+	if tpl == "" {
+		return nil, nil
+	}
+	return template.New("hostname").Option("missingkey=error").Parse(tpl)
+}
+
+// isExported checks if a service with the given annotations is exported, either with a hostname annotation
+// or with a hostname derived from the template.
+func (app *App) isExported(namespace string, a annotations) bool {
+	return hasHostnameAnnotation(a) || app.useHostnameTemplate(namespace, a)
+}
+
+// useHostnameTemplate checks if the hostname of a service is derived from the template.
+// Services opt in with the AutoHostnameAnnotationKey annotation or by belonging to one of the configured namespaces.
+// The annotation takes precedence, so that a service can opt out within such a namespace.
+func (app *App) useHostnameTemplate(namespace string, a annotations) bool {
+	if app.opts.hostnameTemplate == nil {
+		return false
+	}
+	if v, ok := a.get(AutoHostnameAnnotationKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		return err == nil && enabled
+	}
+	return Contains(app.opts.templateNamespaces, namespace)
+}
+
+// renderHostnames evaluates the hostname template over the service.
+// Like the hostname annotation, the template can produce several comma separated hostnames.
+func (app *App) renderHostnames(s *ServiceMeta) ([]string, error) {
+	var b strings.Builder
+	if err := app.opts.hostnameTemplate.Execute(&b, s); err != nil {
+		return nil, fmt.Errorf("error executing hostname template: %w", err)
+	}
+
+	names := splitValues(strings.ToLower(b.String()))
+	if len(names) == 0 {
+		return nil, fmt.Errorf("hostname template produced an empty hostname")
+	}
+	return names, nil
+}
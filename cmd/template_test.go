@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostnameTemplate(t *testing.T) {
+	tpl, err := initHostnameTemplate("{{.Name}}.{{.Namespace}}.{{.Datacenter}}.svc.example.com")
+	require.NoError(t, err)
+
+	app := &App{opts: Opts{hostnameTemplate: tpl, templateNamespaces: []string{"platform"}}}
+
+	// Services in the namespaces opt in, unless they opt out with the tag.
+	assert.True(t, app.useHostnameTemplate("platform", nil))
+	assert.False(t, app.useHostnameTemplate("platform", annotations{"auto-hostname": {"false"}}))
+	assert.False(t, app.useHostnameTemplate("default", nil))
+	assert.True(t, app.useHostnameTemplate("default", annotations{"auto-hostname": {"true"}}))
+
+	// An explicit hostname is always exported.
+	assert.True(t, app.isExported("default", annotations{"hostname": {"web.example.com"}}))
+
+	names, err := app.renderHostnames(&ServiceMeta{Name: "Web", Namespace: "platform", Datacenter: "dc1"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"web.platform.dc1.svc.example.com"}, names)
+
+	// Without a template, services are only exported with a hostname annotation.
+	app.opts.hostnameTemplate = nil
+	assert.False(t, app.isExported("platform", annotations{"auto-hostname": {"true"}}))
+
+	_, err = initHostnameTemplate("{{.Name")
+	assert.Error(t, err)
+}
@@ -2,52 +2,214 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"time"
 )
 
+// errNoHealthyAllocations is reported for a service whose records are kept with all of its allocations,
+// as none of them are healthy and health checks fail open.
+var errNoHealthyAllocations = errors.New("none of the allocations are healthy, publishing all of them")
+
 // updateRecords goes through each service in the given map
 // and propagates DNS record changes for new or updated services.
 // The check to see if a service has to be updated reduces the number of
-// API calls to the DNS provider.
-func (app *App) updateRecords(services map[string]ServiceMeta, domains []string) {
+// API calls to the DNS provider. The changes for those services are planned against the current records
+// fetched from the DNS providers, so that the plan holds even if the services in memory don't reflect the
+// records (e.g. after a restart, or when taking over as the leader).
+// The lock is only held to read and record the synced services in `app.services`, not while calling the DNS
+// providers. The zones of the changed services are locked instead, so that they aren't pruned concurrently.
+// In dry run mode, the changes are only logged and nothing is sent to the DNS provider.
+// It returns an error if the records of any of the services couldn't be updated in the DNS providers.
+func (app *App) updateRecords(ctx context.Context, services map[string]ServiceMeta, domains []string) error {
 	app.RLock()
-	defer app.RUnlock()
+	resync := app.resync
+	app.RUnlock()
+	synced := app.syncedServices()
 
+	var (
+		records = make(map[string]RecordMeta) // Key of the service to its records.
+		zones   = make(map[string]struct{})
+	)
 	for key, service := range services {
-		if isNewOrUpdatedService(app.services[key], service) {
-			app.lo.Debug("Service is new or updated", "service", service.DNSName)
-			if err := app.propogateChange(key, service, domains); err != nil {
-				app.lo.Error("Error updating DNS records for service", "service", service.DNSName, "error", err)
-				// Continue processing other services even if this one fails.
+		if !resync && !isNewOrUpdatedService(synced[key], service) {
+			continue
+		}
+
+		app.lo.Debug("Service is new or updated", "service", service.DNSName)
+		if service.Unhealthy && !app.opts.healthyFailOpen {
+			// None of the allocations are healthy, so all the records at the names of the service are deleted.
+			_, zone, _, err := service.parseTags(domains)
+			app.inspect.setError(key, service, err, time.Now())
+			if err != nil {
+				app.lo.Error("Error converting service to record", "service", service.DNSName, "error", err)
 				continue
 			}
+			app.lo.Warn("None of the allocations of the service are healthy, withdrawing its records", "service", service.DNSName)
+			records[key] = RecordMeta{Zone: EnsureFQDN(zone)}
+			zones[EnsureFQDN(zone)] = struct{}{}
+			continue
+		}
+
+		record, err := service.ToRecord(domains, app.opts.owner)
+		if err == nil && service.Unhealthy {
+			app.lo.Warn("None of the allocations of the service are healthy, failing open with all of them", "service", service.DNSName)
+			app.inspect.setError(key, service, errNoHealthyAllocations, time.Now())
+		} else {
+			app.inspect.setError(key, service, err, time.Now())
+		}
+		if err != nil {
+			app.lo.Error("Error converting service to record", "service", service.DNSName, "error", err)
+			continue
+		}
+		records[key] = record
+		zones[record.Zone] = struct{}{}
+	}
+
+	// Fetch the owned records in the zones of the changed services.
+	var (
+		owned    = make(map[string][]RecordMeta)
+		existing = make(zoneRecords)
+		failed   = make(map[string]error)
+		names    = make([]string, 0, len(zones))
+	)
+	for zone := range zones {
+		names = append(names, zone)
+	}
+	unlock := app.zones.lock(names)
+	defer unlock()
+
+	for zone := range zones {
+		p, err := app.providerForZone(zone)
+		if err == nil {
+			err = app.fetchZoneRecords(ctx, p, zone, app.clusters(), owned, existing)
+		}
+		if err != nil {
+			failed[zone] = err
+		}
+	}
+
+	// Compare the records of each service against the owned records at its names. Record types which the service
+	// no longer publishes (e.g. an A record when it moves to IPv6) are deleted along with the update.
+	var (
+		desired = make([]RecordMeta, 0, len(records))
+		current = make([]RecordMeta, 0)
+	)
+	for key, record := range records {
+		if _, ok := failed[record.Zone]; ok {
+			continue
+		}
+		desired = append(desired, record)
+		svc := services[key]
+		for _, name := range svc.recordNames() {
+			current = append(current, owned[name]...)
+		}
+	}
+
+	plan := app.plan(desired, current, existing)
+	app.inspect.setSyncPlan(plan, time.Now())
+
+	if app.opts.dryRun {
+		app.logDryRun(plan)
+	} else {
+		for zone, err := range app.applyPlan(ctx, plan) {
+			failed[zone] = err
+		}
+	}
+
+	app.Lock()
+	for key, record := range records {
+		if err, ok := failed[record.Zone]; ok {
+			app.lo.Error("Error updating DNS records for service", "service", services[key].DNSName, "error", err)
+			app.inspect.setError(key, services[key], err, time.Now())
+			continue
 		}
+		// In dry run mode, the services are marked as synced as well, so that the same change isn't planned again in the next cycle.
+		app.services[key] = services[key]
+	}
+	app.Unlock()
+
+	if len(failed) > 0 {
+		return fmt.Errorf("error updating records in %d zones", len(failed))
 	}
+	return nil
 }
 
 // isNewOrUpdatedService checks if the service is new or has been updated.
 func isNewOrUpdatedService(existingService, newService ServiceMeta) bool {
-	// If the service does not exist or its addresses or tags have changed,
+	// If the service does not exist or its addresses, ports, tags or annotations have changed,
 	// it's considered a new or updated service.
 	return existingService.Name == "" ||
 		!sameStringSlice(existingService.Addresses, newService.Addresses) ||
-		!sameStringSlice(existingService.Tags, newService.Tags)
+		!sameEndpoints(existingService.Endpoints, newService.Endpoints) ||
+		!sameStringSlice(existingService.Tags, newService.Tags) ||
+		!sameAnnotations(existingService.Annotations, newService.Annotations) ||
+		existingService.Unhealthy != newService.Unhealthy
 }
 
-// propogateChange updates DNS records for the given service and returns any error encountered.
-func (app *App) propogateChange(key string, svc ServiceMeta, domains []string) error {
-	record, err := svc.ToRecord(domains, app.opts.owner)
+// applyPlan sends the changes of the plan to the providers which own the zones of the records
+// and returns the zones for which a change failed, along with the error.
+// Record sets are created and updated before the left over ones are deleted, except for the ones
+// which conflict with a CNAME at the same name.
+func (app *App) applyPlan(ctx context.Context, plan Plan) map[string]error {
+	failed := make(map[string]error)
+
+	before, after := plan.splitDeletes()
+	app.deleteChanges(ctx, before, failed)
+
+	for _, record := range groupChanges(append(append([]Change{}, plan.Creates...), plan.Updates...)) {
+		if err := app.propogateChange(ctx, record); err != nil {
+			failed[record.Zone] = err
+		}
+	}
+
+	app.deleteChanges(ctx, after, failed)
+	return failed
+}
+
+// propogateChange creates or updates the DNS records in a zone and returns any error encountered.
+// The records are sent to the provider which owns the zone of the record.
+func (app *App) propogateChange(ctx context.Context, record RecordMeta) error {
+	p, err := app.providerForZone(record.Zone)
 	if err != nil {
-		app.lo.Error("error converting service to record", "error", err)
 		return err
 	}
 
-	_, err = app.provider.SetRecords(context.Background(), record.Zone, record.Records)
+	if record.Proxied != nil {
+		ctx = withProxied(ctx, *record.Proxied)
+	}
+
+	start := time.Now()
+	_, err = p.provider.SetRecords(ctx, record.Zone, record.Records)
+	app.observeProviderCall(p.name, "set", record.Zone, start, err)
 	if err != nil {
-		app.lo.Error("error setting records to zone", "error", err)
+		app.lo.Error("error setting records to zone", "provider", p.name, "error", err)
 		return err
 	}
 
-	app.lo.Info("Updated DNS records", "zone", record.Zone, "records", record.Records)
-	app.services[key] = svc
+	app.lo.Info("Updated DNS records", "provider", p.name, "zone", record.Zone, "records", record.Records)
 	return nil
 }
+
+// deleteChanges deletes the record sets of the changes from the providers which own their zones.
+// The zones for which a deletion failed are recorded in `failed`.
+func (app *App) deleteChanges(ctx context.Context, changes []Change, failed map[string]error) {
+	for _, record := range groupChanges(changes) {
+		p, err := app.providerForZone(record.Zone)
+		if err != nil {
+			failed[record.Zone] = err
+			continue
+		}
+
+		start := time.Now()
+		_, err = p.provider.DeleteRecords(ctx, record.Zone, record.Records)
+		app.observeProviderCall(p.name, "delete", record.Zone, start, err)
+		if err != nil {
+			app.lo.Error("Error deleting records", "provider", p.name, "zone", record.Zone, "error", err)
+			failed[record.Zone] = err
+			continue
+		}
+
+		app.lo.Info("Deleted DNS records", "provider", p.name, "zone", record.Zone, "records", record.Records)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateRecordsAgainstProvider(t *testing.T) {
+	const zone = "test.internal."
+	svc := ServiceMeta{
+		Name:      "redis",
+		Namespace: "default",
+		Cluster:   "default",
+		DNSName:   "redis.test.internal",
+		Addresses: []string{"10.0.0.1"},
+		Tags:      []string{"external-dns/hostname=redis.test.internal"},
+	}
+	services := map[string]ServiceMeta{"redis.test.internal.": svc}
+
+	// The records of the service exist already, e.g. when the program restarts.
+	p := &memProvider{records: make(map[string][]libdns.Record)}
+	record, err := svc.ToRecord([]string{"test.internal"}, "test-owner")
+	require.NoError(t, err)
+	_, err = p.SetRecords(context.Background(), zone, record.Records)
+	require.NoError(t, err)
+	p.changes = 0
+
+	// The services in memory are empty after a restart, but nothing is changed as the records are up to date.
+	app := newCLITestApp(p)
+	require.NoError(t, app.updateRecords(context.Background(), services, app.opts.domains))
+	assert.Equal(t, 0, p.changes)
+	assert.Contains(t, app.services, "redis.test.internal.")
+
+	// Records which drifted are updated, with the previous value from the provider.
+	app = newCLITestApp(p)
+	app.opts.dryRun = true
+	_, err = p.SetRecords(context.Background(), zone, []libdns.Record{{Type: "A", Name: "redis", Value: "10.0.0.9", TTL: DefaultTTL}})
+	require.NoError(t, err)
+	p.changes = 0
+	require.NoError(t, app.updateRecords(context.Background(), services, app.opts.domains))
+	assert.Equal(t, 0, p.changes, "nothing is changed in dry run mode")
+	plan := app.inspect.syncPlan.plan
+	require.Len(t, plan.Updates, 1)
+	assert.Equal(t, "10.0.0.9", plan.Updates[0].Previous.Value)
+
+	app = newCLITestApp(p)
+	require.NoError(t, app.updateRecords(context.Background(), services, app.opts.domains))
+	assert.Equal(t, []string{"10.0.0.1"}, p.values(zone, "redis.test.internal.", "A"))
+
+	// Record types which the service no longer publishes are deleted.
+	svc.Addresses = []string{"2001:db8::1"}
+	services["redis.test.internal."] = svc
+	require.NoError(t, app.updateRecords(context.Background(), services, app.opts.domains))
+	assert.Empty(t, p.values(zone, "redis.test.internal.", "A"))
+	assert.Equal(t, []string{"2001:db8::1"}, p.values(zone, "redis.test.internal.", "AAAA"))
+
+	// Unchanged services aren't compared against the provider again, unless a resync is due.
+	p.changes = 0
+	_, err = p.SetRecords(context.Background(), zone, []libdns.Record{{Type: "AAAA", Name: "redis", Value: "2001:db8::9", TTL: DefaultTTL}})
+	require.NoError(t, err)
+	require.NoError(t, app.updateRecords(context.Background(), services, app.opts.domains))
+	assert.Equal(t, 1, p.changes)
+	app.resync = true
+	require.NoError(t, app.updateRecords(context.Background(), services, app.opts.domains))
+	assert.Equal(t, []string{"2001:db8::1"}, p.values(zone, "redis.test.internal.", "AAAA"))
+}
+
+func TestUpdateRecordsCreateOnly(t *testing.T) {
+	const zone = "test.internal."
+	service := func(name, addr string) ServiceMeta {
+		return ServiceMeta{
+			Name:      name,
+			Namespace: "default",
+			Cluster:   "default",
+			DNSName:   name + ".test.internal",
+			Addresses: []string{addr},
+			Tags:      []string{"external-dns/hostname=" + name + ".test.internal"},
+		}
+	}
+	services := map[string]ServiceMeta{
+		"redis.test.internal.": service("redis", "10.0.0.1"),
+		"web.test.internal.":   service("web", "10.0.0.2"),
+		"api.test.internal.":   service("api", "10.0.0.3"),
+	}
+
+	// `redis` was published with another address before the restart, and `web` is managed by hand.
+	p := &memProvider{records: make(map[string][]libdns.Record)}
+	redis := service("redis", "10.0.0.9")
+	record, err := redis.ToRecord([]string{"test.internal"}, "test-owner")
+	require.NoError(t, err)
+	_, err = p.SetRecords(context.Background(), zone, append(record.Records, libdns.Record{Type: "A", Name: "web", Value: "10.0.0.5", TTL: DefaultTTL}))
+	require.NoError(t, err)
+
+	// The services in memory are empty after a restart, but only the records of the new service are created.
+	app := newCLITestApp(p)
+	app.opts.policy = policyCreateOnly
+	require.NoError(t, app.updateRecords(context.Background(), services, app.opts.domains))
+
+	assert.Equal(t, []string{"10.0.0.9"}, p.values(zone, "redis.test.internal.", "A"))
+	assert.Equal(t, []string{"10.0.0.5"}, p.values(zone, "web.test.internal.", "A"))
+	assert.Empty(t, p.values(zone, "web.test.internal.", "TXT"))
+	assert.Equal(t, []string{"10.0.0.3"}, p.values(zone, "api.test.internal.", "A"))
+	assert.Len(t, p.values(zone, "api.test.internal.", "TXT"), 1)
+
+	// The prune doesn't change the existing records either.
+	app.sources[0].synced = true
+	require.NoError(t, app.cleanupRecords(context.Background()))
+	assert.Equal(t, []string{"10.0.0.9"}, p.values(zone, "redis.test.internal.", "A"))
+	assert.Equal(t, []string{"10.0.0.5"}, p.values(zone, "web.test.internal.", "A"))
+	assert.Empty(t, p.values(zone, "web.test.internal.", "TXT"))
+}
+
+func TestUpdateRecordsUnhealthy(t *testing.T) {
+	const zone = "test.internal."
+	svc := ServiceMeta{
+		Name:      "redis",
+		Namespace: "default",
+		Cluster:   "default",
+		DNSName:   "redis.test.internal",
+		Addresses: []string{"10.0.0.1"},
+		Endpoints: []Endpoint{{AllocID: "alloc-1", Address: "10.0.0.1", Port: 6379}},
+		Tags:      []string{"external-dns/hostname=redis.test.internal"},
+	}
+	p := &memProvider{records: make(map[string][]libdns.Record)}
+	app := newCLITestApp(p)
+	require.NoError(t, app.updateRecords(context.Background(), map[string]ServiceMeta{"redis.test.internal.": svc}, app.opts.domains))
+	require.Equal(t, []string{"10.0.0.1"}, p.values(zone, "redis.test.internal.", "A"))
+
+	// When failing open, the records are kept with all the allocations, and the service is reported.
+	unhealthy := svc
+	unhealthy.Unhealthy = true
+	app.opts.healthyFailOpen = true
+	require.NoError(t, app.updateRecords(context.Background(), map[string]ServiceMeta{"redis.test.internal.": unhealthy}, app.opts.domains))
+	assert.Equal(t, []string{"10.0.0.1"}, p.values(zone, "redis.test.internal.", "A"))
+	assert.Equal(t, errNoHealthyAllocations, app.inspect.errors["redis.test.internal."].err)
+
+	// Otherwise, the records of the service are withdrawn until an allocation is healthy again.
+	app.opts.healthyFailOpen = false
+	unhealthy.Addresses, unhealthy.Endpoints = []string{}, []Endpoint{}
+	require.NoError(t, app.updateRecords(context.Background(), map[string]ServiceMeta{"redis.test.internal.": unhealthy}, app.opts.domains))
+	assert.Empty(t, p.values(zone, "redis.test.internal.", "A"))
+	assert.Empty(t, p.values(zone, "redis.test.internal.", "TXT"))
+	assert.NotContains(t, app.inspect.errors, "redis.test.internal.")
+
+	require.NoError(t, app.updateRecords(context.Background(), map[string]ServiceMeta{"redis.test.internal.": svc}, app.opts.domains))
+	assert.Equal(t, []string{"10.0.0.1"}, p.values(zone, "redis.test.internal.", "A"))
+}
+
+// blockingProvider is a memProvider whose calls to get the records of a zone block until they're released.
+type blockingProvider struct {
+	*memProvider
+	gets    chan string
+	release chan struct{}
+}
+
+func (b *blockingProvider) GetRecords(ctx context.Context, zone string) ([]libdns.Record, error) {
+	b.gets <- zone
+	<-b.release
+	return b.memProvider.GetRecords(ctx, zone)
+}
+
+func TestUpdateRecordsLocking(t *testing.T) {
+	const zone = "test.internal."
+	svc := ServiceMeta{
+		Name:      "redis",
+		Namespace: "default",
+		Cluster:   "default",
+		DNSName:   "redis.test.internal",
+		Addresses: []string{"10.0.0.1"},
+		Tags:      []string{"external-dns/hostname=redis.test.internal"},
+	}
+	p := &blockingProvider{
+		memProvider: &memProvider{records: make(map[string][]libdns.Record)},
+		gets:        make(chan string, 2),
+		release:     make(chan struct{}),
+	}
+	app := newCLITestApp(p.memProvider)
+	app.providers[0].provider = p
+	app.sources[0].synced = true
+
+	updated := make(chan error)
+	go func() {
+		updated <- app.updateRecords(context.Background(), map[string]ServiceMeta{"redis.test.internal.": svc}, app.opts.domains)
+	}()
+	assert.Equal(t, zone, <-p.gets)
+
+	// The services can be read while the records are fetched from the provider.
+	read := make(chan map[string]ServiceMeta)
+	go func() { read <- app.syncedServices() }()
+	select {
+	case services := <-read:
+		assert.Empty(t, services)
+	case <-time.After(time.Second):
+		t.Fatal("the services are locked while calling the provider")
+	}
+
+	// A prune of the same zone waits for the sync, so that it doesn't delete the records being created.
+	pruned := make(chan error)
+	go func() { pruned <- app.cleanupRecords(context.Background()) }()
+	select {
+	case <-p.gets:
+		t.Fatal("the zone is pruned while it's synced")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(p.release)
+	require.NoError(t, <-updated)
+	require.NoError(t, <-pruned)
+	assert.Contains(t, app.services, "redis.test.internal.")
+	assert.Equal(t, []string{"10.0.0.1"}, p.values(zone, "redis.test.internal.", "A"))
+}
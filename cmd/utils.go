@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net/netip"
 	"sort"
 	"strings"
 
@@ -37,16 +38,9 @@ func sameStringSlice(s1, s2 []string) bool {
 	return true
 }
 
-// hasHostnameAnnotation checks if the provided tags contain a hostname annotation.
-// The function iterates over the tags and returns true if a tag with the HostnameAnnotationKey prefix is found.
-// If no such tag is found, the function returns false.
-func hasHostnameAnnotation(tags []string) bool {
-	for _, t := range tags {
-		if strings.HasPrefix(t, HostnameAnnotationKey) {
-			return true
-		}
-	}
-	return false
+// hasHostnameAnnotation checks if the provided annotations contain a hostname.
+func hasHostnameAnnotation(a annotations) bool {
+	return len(getDNSNames(a)) > 0
 }
 
 // uniqueAddresses generates a slice of unique addresses from a provided slice of ServiceRegistration pointers.
@@ -65,14 +59,58 @@ func uniqueAddresses(svcRegistrations []*api.ServiceRegistration) []string {
 	return addr
 }
 
-// getDNSNameFromTags extracts the DNS name from the service's tags.
-func getDNSNameFromTags(tags []string) string {
-	for _, tag := range tags {
-		if strings.HasPrefix(tag, HostnameAnnotationKey+"=") {
-			return strings.TrimPrefix(tag, HostnameAnnotationKey+"=")
+// serviceEndpoints generates a slice of endpoints, one for each registration, sorted by the allocation ID.
+func serviceEndpoints(svcRegistrations []*api.ServiceRegistration) []Endpoint {
+	endpoints := make([]Endpoint, 0, len(svcRegistrations))
+	for _, s := range svcRegistrations {
+		endpoints = append(endpoints, Endpoint{AllocID: s.AllocID, Address: s.Address, Port: s.Port})
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].AllocID < endpoints[j].AllocID
+	})
+	return endpoints
+}
+
+// sameEndpoints checks if two slices of endpoints sorted by allocation ID are equal.
+func sameEndpoints(e1, e2 []Endpoint) bool {
+	if len(e1) != len(e2) {
+		return false
+	}
+	for i := range e1 {
+		if e1[i] != e2[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// addressRecord returns the type of the address record (A or AAAA) for an IP address, along with
+// the address in the canonical form in which it's published.
+// It returns an empty type if the address isn't a valid IP address.
+func addressRecord(addr string) (typ, value string) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return "", ""
+	}
+	// IPv4-mapped IPv6 addresses are published as A records, with the IPv4 address.
+	if ip = ip.Unmap(); ip.Is4() {
+		return "A", ip.String()
+	}
+	return "AAAA", ip.String()
+}
+
+// getDNSNames extracts the DNS names from the service's annotations.
+// Hostnames can be set as a comma separated value or with repeated tags. Duplicates are removed.
+func getDNSNames(a annotations) []string {
+	names := make([]string, 0, 1)
+	for _, value := range a.all(HostnameAnnotationKey) {
+		for _, name := range splitValues(value) {
+			if !Contains(names, name) {
+				names = append(names, name)
+			}
 		}
 	}
-	return ""
+	return names
 }
 
 // EnsureFQDN makes sure the domain name is fully qualified (i.e., ends with a dot).
@@ -82,3 +120,15 @@ func EnsureFQDN(name string) string {
 	}
 	return name
 }
+
+// splitValues splits a comma separated record value into individual values.
+// Multiple values of a record set are joined with `,` in a single libdns.Record.
+func splitValues(value string) []string {
+	values := make([]string, 0)
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
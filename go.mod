@@ -3,9 +3,11 @@ module github.com/mr-karan/nomad-external-dns
 go 1.19
 
 require (
-	github.com/hashicorp/nomad/api v0.0.0-20230627233251-f3df01e4220d
+	github.com/VictoriaMetrics/metrics v1.38.0
+	github.com/hashicorp/nomad/api v0.0.0-20240604134157-e73d8bb1140d
 	github.com/knadh/koanf v1.5.0
 	github.com/libdns/libdns v0.2.1
+	github.com/miekg/dns v1.1.55
 	github.com/mr-karan/libdns-route53 v1.4.0
 	github.com/spf13/pflag v1.0.5
 	github.com/stretchr/testify v1.8.1
@@ -41,6 +43,11 @@ require (
 	github.com/mitchellh/reflectwalk v1.0.2 // indirect
 	github.com/pelletier/go-toml v1.9.5 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/sys v0.9.0 // indirect
+	github.com/valyala/fastrand v1.1.0 // indirect
+	github.com/valyala/histogram v1.2.0 // indirect
+	golang.org/x/mod v0.11.0 // indirect
+	golang.org/x/net v0.2.0 // indirect
+	golang.org/x/sys v0.15.0 // indirect
+	golang.org/x/tools v0.3.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )